@@ -10,9 +10,16 @@ package main
 import (
 	"io"
 	"log"
+	"net/http/httptest"
+	"regexp"
 	"testing"
+	"time"
 
+	"github.com/benc-uk/dapr-store/cmd/cart/impl"
 	"github.com/benc-uk/dapr-store/cmd/cart/mock"
+	"github.com/benc-uk/dapr-store/cmd/cart/spec"
+	orderspec "github.com/benc-uk/dapr-store/cmd/orders/spec"
+	productspec "github.com/benc-uk/dapr-store/cmd/products/spec"
 	"github.com/benc-uk/go-rest-api/pkg/api"
 	"github.com/benc-uk/go-rest-api/pkg/auth"
 	"github.com/benc-uk/go-rest-api/pkg/httptester"
@@ -34,6 +41,156 @@ func TestCart(t *testing.T) {
 	api.addRoutes(router, auth.NewPassthroughValidator())
 
 	httptester.Run(t, router, testCases)
+
+	// Rest of tests don't go through the router/api
+
+	t.Run("cart etag and if-match", func(t *testing.T) {
+		get := httptest.NewRecorder()
+		router.ServeHTTP(get, httptest.NewRequest("GET", "/get/mock@example.net", nil))
+
+		etag := get.Header().Get("ETag")
+		if etag == "" {
+			t.Fatalf("'cart etag and if-match' no ETag returned")
+		}
+
+		stale := httptest.NewRequest("PUT", "/setProduct/mock@example.net/prd1/3", nil)
+		stale.Header.Set("If-Match", `"stale"`)
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, stale)
+
+		if rec.Code != 412 {
+			t.Errorf("'cart etag and if-match' stale cart got status %d, wanted 412", rec.Code)
+		}
+
+		current := httptest.NewRequest("PUT", "/setProduct/mock@example.net/prd1/3", nil)
+		current.Header.Set("If-Match", etag)
+
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, current)
+
+		if rec.Code != 200 || rec.Header().Get("ETag") == etag {
+			t.Errorf("'cart etag and if-match' current cart got status %d and ETag %s", rec.Code, rec.Header().Get("ETag"))
+		}
+	})
+
+	t.Run("if-match change is not retried", func(t *testing.T) {
+		svc := mock.CartService{}
+		cart, _ := svc.Get("mock@example.net")
+		cart.IfMatch = cart.ETag
+
+		// Someone else changes the cart after it was checked, but before it is saved
+		other, _ := svc.Get("mock@example.net")
+		_ = svc.SetProductCount(other, "prd1", 4)
+
+		err := svc.SetProductCount(cart, "prd1", 5)
+		if cartErr, ok := err.(impl.CartError); !ok || cartErr.Error() != impl.StaleError {
+			t.Errorf("'if-match change is not retried' failed: %+v", err)
+		}
+	})
+
+	t.Run("merge guest cart rules", func(t *testing.T) {
+		guest := spec.Cart{Products: map[string]int{"prd1": 1, "prd2": 5}}
+
+		for rule, want := range map[spec.MergeRule]int{spec.MergeSum: 8, spec.MergeMax: 5, spec.MergePreferGuest: 5} {
+			cart := &spec.Cart{Products: map[string]int{"prd2": 3, "prd3": 2}}
+			spec.MergeCarts(cart, guest, rule)
+
+			if cart.Products["prd1"] != 1 || cart.Products["prd2"] != want || cart.Products["prd3"] != 2 {
+				t.Errorf("'merge guest cart rules' %s failed: %+v", rule, cart.Products)
+			}
+		}
+
+		cart := &spec.Cart{Products: map[string]int{"prd2": 9}}
+		spec.MergeCarts(cart, guest, spec.MergePreferGuest)
+
+		if cart.Products["prd2"] != 5 {
+			t.Errorf("'merge guest cart rules' prefer guest failed: %+v", cart.Products)
+		}
+	})
+
+	t.Run("idle carts detected", func(t *testing.T) {
+		now := time.Now().UTC()
+		active := spec.ActiveCarts{}
+
+		active.Touch(spec.Cart{ForUserID: "recent", Products: map[string]int{"prd1": 1}, Updated: now.Add(-time.Hour)})
+		active.Touch(spec.Cart{ForUserID: "old", Products: map[string]int{"prd1": 1}, Updated: now.Add(-48 * time.Hour)})
+		active.Touch(spec.Cart{ForUserID: "older", Products: map[string]int{"prd1": 1}, Updated: now.Add(-72 * time.Hour)})
+		active.Touch(spec.Cart{ForUserID: "emptied", Products: map[string]int{"prd1": 1}, Updated: now.Add(-72 * time.Hour)})
+		active.Touch(spec.Cart{ForUserID: "emptied", Products: map[string]int{}, Updated: now})
+
+		idle := active.Idle(24*time.Hour, now)
+		if len(idle) != 2 || idle[0] != "older" || idle[1] != "old" || len(active) != 3 {
+			t.Errorf("'idle carts detected' failed: %v %+v", idle, active)
+		}
+	})
+
+	t.Run("priced cart matches order", func(t *testing.T) {
+		items := []orderspec.LineItem{
+			{Product: productspec.Product{ID: "prd3", Cost: 11.2}, Count: 2},
+			{Product: productspec.Product{ID: "prd1", Cost: 0.99}, Count: 3},
+		}
+
+		priced := spec.NewPricedCart("mock@example.net", items, 20, 0)
+		if priced.Total != 25.37 || priced.Net != 21.15 || priced.Tax != 4.22 || priced.Items != 5 ||
+			priced.Lines[0].Product.ID != "prd1" || priced.Lines[0].Total != 2.97 || priced.Lines[1].Net != 18.67 {
+			t.Errorf("'priced cart matches order' failed: %+v", priced)
+		}
+
+		if lines := priced.LineItems(); len(lines) != 2 || lines[1].Count != 2 {
+			t.Errorf("'priced cart matches order' line items failed: %+v", lines)
+		}
+	})
+
+	t.Run("priced cart discounts offers", func(t *testing.T) {
+		items := []orderspec.LineItem{
+			{Product: productspec.Product{ID: "prd3", Name: "Tie", Cost: 11.2, OnOffer: true}, Count: 2},
+			{Product: productspec.Product{ID: "prd1", Cost: 0.99}, Count: 3},
+		}
+
+		priced := spec.NewPricedCart("mock@example.net", items, 20, 10)
+		if priced.Total != 23.13 || priced.Discount != 2.24 || len(priced.Discounts) != 1 || priced.Discounts[0].ProductID != "prd3" ||
+			priced.Discounts[0].Amount != 2.24 || priced.Discounts[0].Description != "10% off Tie, on offer" {
+			t.Errorf("'priced cart discounts offers' failed: %+v", priced)
+		}
+
+		// The order gets the reduced cost, so it adds up to the same total
+		if lines := priced.LineItems(); lines[1].Product.Cost != 10.08 || lines[1].Total()+lines[0].Total() != priced.Total {
+			t.Errorf("'priced cart discounts offers' line items failed: %+v", lines)
+		}
+
+		if priced := spec.NewPricedCart("mock@example.net", items, 20, 0); priced.Discount != 0 || len(priced.Discounts) != 0 {
+			t.Errorf("'priced cart discounts offers' gave a discount when turned off: %+v", priced)
+		}
+	})
+
+	t.Run("ulid ids are unique and sorted", func(t *testing.T) {
+		ids := impl.NewIDGenerator(impl.IDFormatULID)
+		last := ""
+
+		// Plenty of these will be made in the same millisecond
+		for i := 0; i < 1000; i++ {
+			id := ids.NewID()
+			if len(id) != 26 || id <= last {
+				t.Fatalf("'ulid ids are unique and sorted' failed: %s after %s", id, last)
+			}
+
+			last = id
+		}
+	})
+
+	t.Run("uuidv7 ids are valid and sorted", func(t *testing.T) {
+		ids := impl.NewIDGenerator(impl.IDFormatUUIDv7)
+		format := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+		first := ids.NewID()
+		time.Sleep(2 * time.Millisecond)
+		second := ids.NewID()
+
+		if !format.MatchString(first) || !format.MatchString(second) || second <= first {
+			t.Errorf("'uuidv7 ids are valid and sorted' failed: %s then %s", first, second)
+		}
+	})
 }
 
 // ==========================================================================
@@ -82,7 +239,25 @@ var testCases = []httptester.TestCase{
 		Body:           "",
 		CheckBody:      "product count",
 		CheckBodyCount: 1,
-		CheckStatus:    500,
+		CheckStatus:    422,
+	},
+	{
+		Name:           "set count over maximum",
+		URL:            "/setProduct/mock@example.net/fake-77/100",
+		Method:         "PUT",
+		Body:           "",
+		CheckBody:      "no more than 99",
+		CheckBodyCount: 1,
+		CheckStatus:    422,
+	},
+	{
+		Name:           "set count for product not in catalog",
+		URL:            "/setProduct/mock@example.net/gone-01/1",
+		Method:         "PUT",
+		Body:           "",
+		CheckBody:      "product not found",
+		CheckBodyCount: 1,
+		CheckStatus:    404,
 	},
 	// {
 	// 	Name:           "set count for non-existing user",
@@ -102,6 +277,24 @@ var testCases = []httptester.TestCase{
 		CheckBodyCount: 1,
 		CheckStatus:    200,
 	},
+	{
+		Name:           "get priced cart",
+		URL:            "/priced/mock@example.net",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      `"items":37|"total":371.2`,
+		CheckBodyCount: 2,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "get priced cart with a product gone from the catalog",
+		URL:            "/priced/gone@example.net",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      "product not found: gone-prd",
+		CheckBodyCount: 1,
+		CheckStatus:    404,
+	},
 	{
 		Name:           "get cart for invalid user",
 		URL:            "/get/invalid@example.net",
@@ -147,4 +340,76 @@ var testCases = []httptester.TestCase{
 		CheckBodyCount: 0,
 		CheckStatus:    400,
 	},
+	{
+		Name:           "reorder previous order",
+		URL:            "/reorder/mock@example.net/ord-mock",
+		Method:         "PUT",
+		Body:           "",
+		CheckBody:      `"prd3":2`,
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "reorder non-existent order",
+		URL:            "/reorder/mock@example.net/foo",
+		Method:         "PUT",
+		Body:           "",
+		CheckBody:      "not found",
+		CheckBodyCount: 1,
+		CheckStatus:    404,
+	},
+	{
+		Name:           "reorder another user's order",
+		URL:            "/reorder/david_bowie@example.net/ord-mock",
+		Method:         "PUT",
+		Body:           "",
+		CheckBody:      "not found",
+		CheckBodyCount: 1,
+		CheckStatus:    404,
+	},
+	{
+		Name:           "new guest cart",
+		URL:            "/guest",
+		Method:         "POST",
+		Body:           "",
+		CheckBody:      `"token":"[0-9a-f]{32}"`,
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "get guest cart with bad token",
+		URL:            "/guest/foo",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      "token is not valid",
+		CheckBodyCount: 1,
+		CheckStatus:    400,
+	},
+	{
+		Name:           "set count in guest cart",
+		URL:            "/guest/0123456789abcdef0123456789abcdef/setProduct/prd1/2",
+		Method:         "PUT",
+		Body:           "",
+		CheckBody:      `"prd1":2`,
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "merge guest cart with bad rule",
+		URL:            "/merge/mock@example.net/0123456789abcdef0123456789abcdef?rule=foo",
+		Method:         "PUT",
+		Body:           "",
+		CheckBody:      "merge rule must be",
+		CheckBodyCount: 1,
+		CheckStatus:    400,
+	},
+	{
+		Name:           "merge guest cart",
+		URL:            "/merge/mock@example.net/0123456789abcdef0123456789abcdef?rule=max",
+		Method:         "PUT",
+		Body:           "",
+		CheckBody:      `"prd1":2|"prd3":2|"prd4":5`,
+		CheckBodyCount: 3,
+		CheckStatus:    200,
+	},
 }
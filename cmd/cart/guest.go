@@ -0,0 +1,104 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2020
+// Licensed under the MIT License.
+//
+// Routes for guest carts, and merging them into a user's cart on login
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/benc-uk/dapr-store/cmd/cart/impl"
+	"github.com/benc-uk/dapr-store/cmd/cart/spec"
+	"github.com/benc-uk/go-rest-api/pkg/problem"
+	"github.com/go-chi/chi/v5"
+)
+
+// Start a new guest cart, the token in the response is needed for all other guest calls
+func (api API) newGuestCart(resp http.ResponseWriter, req *http.Request) {
+	token := api.service.NewGuestToken()
+
+	cart, err := api.service.GetGuest(token)
+	if err != nil {
+		problem.Wrap(500, req.RequestURI, "guest", err).Send(resp)
+
+		return
+	}
+
+	api.ReturnJSON(resp, spec.GuestCart{Token: token, Cart: cart})
+}
+
+func (api API) getGuestCart(resp http.ResponseWriter, req *http.Request) {
+	cart, ok := api.guestCart(resp, req)
+	if !ok {
+		return
+	}
+
+	api.returnCart(resp, cart)
+}
+
+func (api API) setGuestProductCount(resp http.ResponseWriter, req *http.Request) {
+	cart, ok := api.guestCart(resp, req)
+	if !ok {
+		return
+	}
+
+	api.setCount(resp, req, cart)
+}
+
+func (api API) clearGuestCart(resp http.ResponseWriter, req *http.Request) {
+	cart, ok := api.guestCart(resp, req)
+	if !ok {
+		return
+	}
+
+	api.clear(resp, req, cart)
+}
+
+// Merge a guest cart into a user's cart, the rule for products in both can be set with ?rule=sum|max|guest
+func (api API) mergeGuestCart(resp http.ResponseWriter, req *http.Request) {
+	userID := chi.URLParam(req, "userId")
+	token := chi.URLParam(req, "token")
+	rule := spec.MergeRule(req.URL.Query().Get("rule"))
+
+	cart, err := api.service.Get(userID)
+	if err != nil {
+		problem.Wrap(500, req.RequestURI, userID, err).Send(resp)
+
+		return
+	}
+
+	if !checkIfMatch(resp, req, cart) {
+		return
+	}
+
+	err = api.service.Merge(cart, token, rule)
+	if err != nil {
+		api.sendCartProblem(resp, req, userID, err)
+
+		return
+	}
+
+	api.returnCart(resp, cart)
+}
+
+// guestCart fetches the cart for the token in the URL, sending a problem if that fails
+func (api API) guestCart(resp http.ResponseWriter, req *http.Request) (*spec.Cart, bool) {
+	token := chi.URLParam(req, "token")
+
+	cart, err := api.service.GetGuest(token)
+	if err != nil {
+		if cartErr, ok := err.(impl.CartError); ok && cartErr.Error() == impl.GuestTokenInvalidError {
+			problem.Wrap(400, req.RequestURI, token, cartErr).Send(resp)
+			return nil, false
+		}
+
+		problem.Wrap(500, req.RequestURI, token, err).Send(resp)
+
+		return nil, false
+	}
+
+	return cart, true
+}
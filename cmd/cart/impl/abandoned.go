@@ -0,0 +1,195 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2020
+// Licensed under the MIT License.
+//
+// Tracking cart activity, and detecting carts that have been abandoned
+// ----------------------------------------------------------------------------
+
+package impl
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	cartspec "github.com/benc-uk/dapr-store/cmd/cart/spec"
+	dapr "github.com/dapr/go-sdk/client"
+)
+
+// Keys in the state store holding the users with carts that are being tracked, and when they were last seen changing
+// The state store can't be searched, so these are the only way to find idle carts
+// Users are spread over a number of keys, so carts changing at the same time rarely write to the same one
+const activeCartsPrefix = "carts-active-"
+const activeCartsShards = 16
+
+// trackActivity makes sure a cart with products in is tracked, errors are only logged as the cart was saved
+// Once a cart is tracked its changes don't need recording, idle carts are found using the time the cart was updated
+// So nothing is written unless the cart isn't tracked yet, and when that fails the next change to the cart tries again
+func (s CartService) trackActivity(cart cartspec.Cart) {
+	// Guest carts are never reminded about, there's no one to send a reminder to
+	if strings.HasPrefix(cart.ForUserID, cartspec.GuestPrefix) || len(cart.Products) == 0 {
+		return
+	}
+
+	key := activeCartsKey(cart.ForUserID)
+
+	for attempt := 1; ; attempt++ {
+		active, etag, err := s.loadActiveCarts(key)
+		if err == nil {
+			if _, tracked := active[cart.ForUserID]; tracked {
+				return
+			}
+
+			active.Touch(cart)
+			err = s.saveActiveCarts(key, active, etag)
+		}
+
+		if err == nil {
+			return
+		}
+
+		if !isConflict(err) || attempt >= maxSaveAttempts {
+			log.Printf("### Warning cart for user %s not tracked, will try again when it next changes: %s", cart.ForUserID, err)
+			return
+		}
+
+		time.Sleep(time.Duration(attempt) * 50 * time.Millisecond)
+	}
+}
+
+// activeCartsKey is the key holding the active carts for a user, always the same one for each user
+func activeCartsKey(userID string) string {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(userID))
+
+	return activeCartsPrefix + strconv.Itoa(int(hash.Sum32()%activeCartsShards))
+}
+
+// RunAbandonedDetector checks for abandoned carts every interval, it blocks so run it as a goroutine
+func (s CartService) RunAbandonedDetector(interval time.Duration) {
+	if s.abandonedAfter <= 0 {
+		log.Printf("### Abandoned cart detection is disabled")
+		return
+	}
+
+	log.Printf("### 🛒 Abandoned cart detector started, carts idle for %s are abandoned", s.abandonedAfter)
+
+	for {
+		if err := s.detectAbandoned(); err != nil {
+			log.Printf("### Error! Abandoned cart detector failed: %s", err)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// detectAbandoned publishes an event for every cart that has been idle too long, then stops tracking it
+// A cart is only reported once for each time it's left idle, a change to the cart starts tracking it again
+func (s CartService) detectAbandoned() error {
+	var lastErr error
+
+	for shard := 0; shard < activeCartsShards; shard++ {
+		key := activeCartsPrefix + strconv.Itoa(shard)
+
+		if err := s.detectAbandonedIn(key); err != nil {
+			log.Printf("### Warning unable to check %s for abandoned carts: %s", key, err)
+
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+// detectAbandonedIn checks the carts tracked under one key for any that are abandoned
+func (s CartService) detectAbandonedIn(key string) error {
+	active, etag, err := s.loadActiveCarts(key)
+	if err != nil {
+		return err
+	}
+
+	// The tracked times are never later than the carts were updated, so these are all the carts that could be idle
+	idle := active.Idle(s.abandonedAfter, time.Now().UTC())
+	if len(idle) == 0 {
+		return nil
+	}
+
+	abandoned := []cartspec.AbandonedCart{}
+
+	for _, userID := range idle {
+		cart, err := s.Get(userID)
+		if err != nil {
+			// Leave the cart tracked, so it's checked again on the next pass
+			log.Printf("### Warning unable to check cart for user %s: %s", userID, err)
+			continue
+		}
+
+		// Changed since it was last seen, so the tracked time is moved up to when it was updated
+		if len(cart.Products) > 0 && time.Since(cart.Updated) <= s.abandonedAfter {
+			active.Touch(*cart)
+			continue
+		}
+
+		delete(active, userID)
+
+		// Empty carts, and carts that have expired, are simply forgotten
+		if len(cart.Products) > 0 {
+			abandoned = append(abandoned, cartspec.AbandonedCart{ForUserID: userID, Products: cart.Products, Updated: cart.Updated})
+		}
+	}
+
+	// Saving with the ETag first means only one replica of the service can report each cart
+	if err := s.saveActiveCarts(key, active, etag); err != nil {
+		if isConflict(err) {
+			log.Printf("### Active carts in %s changed while checking for abandoned carts, will check again later", key)
+			return nil
+		}
+
+		return err
+	}
+
+	for _, cart := range abandoned {
+		if err := s.client.PublishEvent(context.Background(), s.pubSubName, s.abandonedTopic, cart); err != nil {
+			// Log but carry on, the cart isn't tracked any more so this reminder is lost
+			log.Printf("### Warning failed to publish abandoned cart for user %s: %s", cart.ForUserID, err)
+			continue
+		}
+
+		log.Printf("### Cart for user %s was abandoned, idle since %s", cart.ForUserID, cart.Updated.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+func (s CartService) loadActiveCarts(key string) (cartspec.ActiveCarts, string, error) {
+	data, err := s.client.GetState(context.Background(), s.storeName, key, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	active := cartspec.ActiveCarts{}
+
+	if data.Value == nil {
+		return active, data.Etag, nil
+	}
+
+	if err := json.Unmarshal(data.Value, &active); err != nil {
+		return nil, "", err
+	}
+
+	return active, data.Etag, nil
+}
+
+func (s CartService) saveActiveCarts(key string, active cartspec.ActiveCarts, etag string) error {
+	jsonPayload, err := json.Marshal(active)
+	if err != nil {
+		return err
+	}
+
+	return s.client.SaveStateWithETag(context.Background(), s.storeName, key, jsonPayload, etag, nil,
+		dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
+}
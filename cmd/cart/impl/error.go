@@ -7,9 +7,25 @@
 
 package impl
 
+import (
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
 const EmptyError = "cart is empty"
 const CountError = "product count must be > 0"
 const LookupError = "product lookup failed: "
+const ProductMissingPrefix = "product not found: "
+const MaxCountPrefix = "product count must be no more than "
+const IDError = "unable to create a unique order ID"
+const ReorderMissingError = "order to re-order not found"
+const StaleError = "cart has been changed since it was fetched"
+const GuestTokenInvalidError = "guest cart token is not valid"
+const GuestOrderError = "guest carts can't be submitted, sign in and merge the cart first"
+const MergeRuleInvalidError = "merge rule must be 'sum', 'max' or 'guest'"
 
 type CartError struct {
 	err string
@@ -30,3 +46,44 @@ func ProductCountError() CartError {
 func ProductLookupError(prodID string) CartError {
 	return CartError{LookupError + prodID}
 }
+
+func ProductNotFoundError(prodID string) CartError {
+	return CartError{ProductMissingPrefix + prodID}
+}
+
+func ProductMaxCountError(max int) CartError {
+	return CartError{MaxCountPrefix + strconv.Itoa(max)}
+}
+
+func OrderIDError() CartError {
+	return CartError{IDError}
+}
+
+func ReorderNotFoundError() CartError {
+	return CartError{ReorderMissingError}
+}
+
+func StaleCartError() CartError {
+	return CartError{StaleError}
+}
+
+func GuestTokenError() CartError {
+	return CartError{GuestTokenInvalidError}
+}
+
+func GuestSubmitError() CartError {
+	return CartError{GuestOrderError}
+}
+
+func MergeRuleError() CartError {
+	return CartError{MergeRuleInvalidError}
+}
+
+// isConflict checks for an ETag mismatch from the Dapr state store, i.e. the cart was changed by someone else
+func isConflict(err error) bool {
+	if status.Code(err) == codes.Aborted {
+		return true
+	}
+
+	return strings.Contains(strings.ToLower(err.Error()), "etag mismatch")
+}
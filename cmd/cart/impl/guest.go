@@ -0,0 +1,76 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2020
+// Licensed under the MIT License.
+//
+// Carts for anonymous guests, and merging them into a user's cart on login
+// ----------------------------------------------------------------------------
+
+package impl
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"regexp"
+
+	cartspec "github.com/benc-uk/dapr-store/cmd/cart/spec"
+)
+
+// Guest tokens are 128 random bits as hex, anything else is rejected so they can't be used to reach other keys
+var guestTokenFormat = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// NewGuestToken creates a token for a new guest cart, the cart itself isn't saved until products are added
+func (s CartService) NewGuestToken() string {
+	token := make([]byte, 16)
+	_, _ = rand.Read(token)
+
+	return hex.EncodeToString(token)
+}
+
+// GetGuest fetches the cart for a guest token, if none exists an empty cart is returned
+func (s CartService) GetGuest(token string) (*cartspec.Cart, error) {
+	if !guestTokenFormat.MatchString(token) {
+		return nil, GuestTokenError()
+	}
+
+	return s.Get(cartspec.GuestPrefix + token)
+}
+
+// Merge folds a guest cart into a user's cart, e.g. when the guest signs in, then removes the guest cart
+// Products in both carts are merged with the rule given, or the configured rule if that's blank
+func (s CartService) Merge(cart *cartspec.Cart, token string, rule cartspec.MergeRule) error {
+	if rule == "" {
+		rule = s.mergeRule
+	}
+
+	if !rule.Valid() {
+		return MergeRuleError()
+	}
+
+	guest, err := s.GetGuest(token)
+	if err != nil {
+		return err
+	}
+
+	if len(guest.Products) == 0 {
+		return nil
+	}
+
+	err = s.update(cart, func(c *cartspec.Cart) {
+		cartspec.MergeCarts(c, *guest, rule)
+		s.limitQuantities(c)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Log but don't return the error, as the carts were merged
+	if err := s.client.DeleteState(context.Background(), s.storeName, guest.ForUserID, nil); err != nil {
+		log.Printf("### Warning failed to remove guest cart %s after merging: %s", token, err)
+	}
+
+	log.Printf("### Guest cart %s was merged into the cart for user %s", token, cart.ForUserID)
+
+	return nil
+}
@@ -0,0 +1,123 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2020
+// Licensed under the MIT License.
+//
+// Generators of unique order IDs, which sort in the order they were created
+// ----------------------------------------------------------------------------
+
+package impl
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+// Supported ID formats
+const (
+	IDFormatULID   = "ulid"
+	IDFormatUUIDv7 = "uuidv7"
+)
+
+// IDGenerator creates new order IDs
+type IDGenerator interface {
+	NewID() string
+}
+
+// NewIDGenerator creates an IDGenerator for a format, unknown formats fall back to ULID
+func NewIDGenerator(format string) IDGenerator {
+	switch format {
+	case IDFormatULID:
+		return &ULIDGenerator{}
+	case IDFormatUUIDv7:
+		return &UUIDv7Generator{}
+	}
+
+	log.Printf("### Warning unknown order ID format '%s', ULIDs will be used", format)
+
+	return &ULIDGenerator{}
+}
+
+// Crockford's base32, as used by ULIDs, which leaves out I, L, O & U
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULIDGenerator creates ULIDs, 26 characters encoding a 48 bit millisecond timestamp and 80 random bits
+// IDs made in the same millisecond increment the random part, so they still sort in order
+// See: https://github.com/ulid/spec
+type ULIDGenerator struct {
+	lastTime   uint64
+	lastRandom [10]byte
+	lock       sync.Mutex
+}
+
+// NewID creates a new ULID
+func (g *ULIDGenerator) NewID() string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	ms := uint64(time.Now().UnixMilli())
+
+	if ms <= g.lastTime {
+		// Same millisecond (or the clock went backwards) so carry on from the last ID
+		ms = g.lastTime
+		incrementBytes(g.lastRandom[:])
+	} else {
+		_, _ = rand.Read(g.lastRandom[:])
+	}
+
+	g.lastTime = ms
+
+	// 128 bits, which is 26 characters of 5 bits each with 2 bits spare at the top
+	var id [16]byte
+
+	binary.BigEndian.PutUint16(id[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(ms))
+	copy(id[6:], g.lastRandom[:])
+
+	hi := binary.BigEndian.Uint64(id[0:8])
+	lo := binary.BigEndian.Uint64(id[8:16])
+	out := make([]byte, 26)
+
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+
+	return string(out)
+}
+
+// UUIDv7Generator creates version 7 UUIDs, a 48 bit millisecond timestamp followed by random bits
+// See: https://www.rfc-editor.org/rfc/rfc9562#name-uuid-version-7
+type UUIDv7Generator struct{}
+
+// NewID creates a new UUIDv7
+func (g *UUIDv7Generator) NewID() string {
+	var id [16]byte
+
+	_, _ = rand.Read(id[6:])
+
+	ms := uint64(time.Now().UnixMilli())
+	binary.BigEndian.PutUint16(id[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(ms))
+
+	id[6] = 0x70 | id[6]&0x0f // Version 7
+	id[8] = 0x80 | id[8]&0x3f // RFC 4122 variant
+
+	h := hex.EncodeToString(id[:])
+
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// incrementBytes adds one to a big endian number, wrapping around on overflow
+func incrementBytes(b []byte) {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return
+		}
+	}
+}
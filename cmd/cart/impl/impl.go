@@ -11,7 +11,8 @@ import (
 	"context"
 	"encoding/json"
 	"log"
-	"math/rand"
+	"strconv"
+	"strings"
 	"time"
 
 	cartspec "github.com/benc-uk/dapr-store/cmd/cart/spec"
@@ -20,6 +21,8 @@ import (
 
 	"github.com/benc-uk/go-rest-api/pkg/env"
 	dapr "github.com/dapr/go-sdk/client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // CartService is a Dapr implementation of CartService interface
@@ -29,13 +32,56 @@ type CartService struct {
 	storeName   string // Name of Dapr state store
 	serviceName string
 	client      dapr.Client
+	ids         IDGenerator
+	mergeRule   cartspec.MergeRule // Used when merging guest carts, if no rule is given
+
+	abandonedTopic string        // Name of Dapr pub/sub topic for abandoned carts
+	ttl            time.Duration // How long carts are kept after their last change, zero keeps them forever
+	abandonedAfter time.Duration // How long a cart is idle before it's abandoned
+	maxQuantity    int           // Most of any one product allowed in a cart, zero for no limit
+	taxRate        float32       // Percentage of tax included in all prices
+	offerDiscount  float32       // Percentage taken off products that are on offer
 }
 
+// How many times to try saving a cart that is being changed concurrently
+const maxSaveAttempts = 5
+
+// How many new IDs to try when an order ID is already taken
+const maxIDAttempts = 5
+
+// IDs are only reserved for a day, as time based IDs can't collide with ones made earlier than that
+const reservedIDTTL = "86400"
+
 // NewService creates a new CartService
 func NewService(serviceName string) *CartService {
 	topicName := env.GetEnvString("DAPR_ORDERS_TOPIC", "orders-queue")
 	storeName := env.GetEnvString("DAPR_STORE_NAME", "statestore")
 	pubSubName := env.GetEnvString("DAPR_PUBSUB_NAME", "pubsub")
+	idFormat := env.GetEnvString("ORDER_ID_FORMAT", IDFormatULID)
+	mergeRule := cartspec.MergeRule(env.GetEnvString("CART_MERGE_RULE", string(cartspec.MergeSum)))
+	abandonedTopic := env.GetEnvString("DAPR_ABANDONED_TOPIC", "carts-abandoned")
+	ttl := env.GetEnvInt("CART_TTL", 30*24*60*60)
+	abandonedAfter := env.GetEnvInt("CART_ABANDONED_AFTER", 24*60*60)
+	maxQuantity := env.GetEnvInt("CART_MAX_QUANTITY", 99)
+
+	taxRate, err := strconv.ParseFloat(env.GetEnvString("TAX_RATE", "20"), 32)
+	if err != nil {
+		log.Printf("### Warning TAX_RATE is not a number, using 20%%")
+
+		taxRate = 20
+	}
+
+	offerDiscount, err := strconv.ParseFloat(env.GetEnvString("OFFER_DISCOUNT", "0"), 32)
+	if err != nil || offerDiscount < 0 || offerDiscount > 100 {
+		log.Printf("### Warning OFFER_DISCOUNT is not a percentage, no discount will be given")
+
+		offerDiscount = 0
+	}
+
+	if !mergeRule.Valid() {
+		log.Printf("### Warning unknown cart merge rule '%s', carts will be merged with '%s'", mergeRule, cartspec.MergeSum)
+		mergeRule = cartspec.MergeSum
+	}
 
 	// Set up Dapr client & checks for Dapr sidecar, otherwise die
 	client, err := dapr.NewClient()
@@ -49,6 +95,14 @@ func NewService(serviceName string) *CartService {
 		storeName,
 		serviceName,
 		client,
+		NewIDGenerator(idFormat),
+		mergeRule,
+		abandonedTopic,
+		time.Duration(ttl) * time.Second,
+		time.Duration(abandonedAfter) * time.Second,
+		maxQuantity,
+		float32(taxRate),
+		float32(offerDiscount),
 	}
 }
 
@@ -76,10 +130,19 @@ func (s CartService) Get(userID string) (*cartspec.Cart, error) {
 
 		log.Printf("### Warning: Corrupt cart for user %s was removed!!", userID)
 
+		cart = &cartspec.Cart{}
 		cart.ForUserID = userID
 		cart.Products = make(map[string]int)
+
+		return cart, nil
+	}
+
+	if cart.Products == nil {
+		cart.Products = make(map[string]int)
 	}
 
+	cart.ETag = data.Etag
+
 	return cart, nil
 }
 
@@ -89,16 +152,79 @@ func (s CartService) Submit(cart cartspec.Cart) (*orderspec.Order, error) {
 		return nil, EmptyCartError()
 	}
 
-	// Build up line item array
-	lineItems := []orderspec.LineItem{}
+	// Orders need a real user, guests have to sign in and merge their cart first
+	if strings.HasPrefix(cart.ForUserID, cartspec.GuestPrefix) {
+		return nil, GuestSubmitError()
+	}
 
 	// Process the cart server side, calculating the order price
-	// This involves a service to service call to invoke the products service
-	var orderAmount float32
+	priced, err := s.Price(cart)
+	if err != nil {
+		return nil, err
+	}
+
+	orderID, err := s.reserveOrderID()
+	if err != nil {
+		return nil, err
+	}
 
+	// Publish order to the orders queue
+	order := &orderspec.Order{
+		Title:     "Order " + time.Now().Format("15:04 Jan 2 2006"),
+		Amount:    priced.Total,
+		ForUserID: cart.ForUserID,
+		ID:        orderID,
+		Status:    orderspec.OrderNew,
+		LineItems: priced.LineItems(),
+	}
+
+	err = s.client.PublishEvent(context.Background(), s.pubSubName, s.topicName, order)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only take out what was ordered, anything added to the cart in the meantime is kept
+	submitted := map[string]int{}
 	for productID, count := range cart.Products {
+		submitted[productID] = count
+	}
+
+	err = s.update(&cart, func(c *cartspec.Cart) {
+		for productID, count := range submitted {
+			if c.Products[productID] <= count {
+				delete(c.Products, productID)
+			} else {
+				c.Products[productID] -= count
+			}
+		}
+	})
+	if err != nil {
+		// Log but don't return the error, as the order was published
+		log.Printf("### Warning failed to clear cart %s", err)
+	}
+
+	return order, nil
+}
+
+// Price looks up all the products in a cart, and works out what an order for it would cost
+// This is used when submitting the cart, so the price shown to the user is always what they will pay
+func (s CartService) Price(cart cartspec.Cart) (*cartspec.PricedCart, error) {
+	lineItems := []orderspec.LineItem{}
+
+	// This involves a service to service call to invoke the products service
+	for productID, count := range cart.Products {
+		// The limit may have been lowered since the product was added
+		if s.maxQuantity > 0 && count > s.maxQuantity {
+			return nil, ProductMaxCountError(s.maxQuantity)
+		}
+
 		resp, err := s.client.InvokeMethod(context.Background(), "products", `get/`+productID, "get")
 		if err != nil {
+			// The product may have been removed from the catalog since it was added
+			if status.Code(err) == codes.NotFound {
+				return nil, ProductNotFoundError(productID)
+			}
+
 			return nil, ProductLookupError(productID)
 		}
 
@@ -109,90 +235,242 @@ func (s CartService) Submit(cart cartspec.Cart) (*orderspec.Order, error) {
 			return nil, err
 		}
 
-		lineItem := &orderspec.LineItem{
+		lineItems = append(lineItems, orderspec.LineItem{
 			Product: *product,
 			Count:   count,
-		}
-		lineItems = append(lineItems, *lineItem)
+		})
+	}
 
-		orderAmount += (product.Cost * float32(count))
+	priced := cartspec.NewPricedCart(cart.ForUserID, lineItems, s.taxRate, s.offerDiscount)
+
+	return &priced, nil
+}
+
+// SetProductCount updates the count of a given product in the cart
+// Products are checked they exist in the catalog, but can always be removed by setting the count to zero
+func (s CartService) SetProductCount(cart *cartspec.Cart, productID string, count int) error {
+	if count < 0 {
+		return ProductCountError()
 	}
 
-	// Publish order to the orders queue
-	order := &orderspec.Order{
-		Title:     "Order " + time.Now().Format("15:04 Jan 2 2006"),
-		Amount:    orderAmount,
-		ForUserID: cart.ForUserID,
-		ID:        makeID(5),
-		Status:    orderspec.OrderNew,
-		LineItems: lineItems,
+	if s.maxQuantity > 0 && count > s.maxQuantity {
+		return ProductMaxCountError(s.maxQuantity)
 	}
 
-	err := s.client.PublishEvent(context.Background(), s.pubSubName, s.topicName, order)
+	if count > 0 {
+		exists, err := s.productExists(productID)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			return ProductNotFoundError(productID)
+		}
+	}
+
+	return s.update(cart, func(c *cartspec.Cart) {
+		if count == 0 {
+			delete(c.Products, productID)
+		} else {
+			c.Products[productID] = count
+		}
+	})
+}
+
+// Clear the cart
+func (s CartService) Clear(cart *cartspec.Cart) error {
+	return s.update(cart, func(c *cartspec.Cart) {
+		c.Products = map[string]int{}
+	})
+}
+
+// Reorder adds the products from one of the user's previous orders to their cart, with the same counts
+// The order is fetched from the orders service, products no longer in the catalog are skipped and reported
+func (s CartService) Reorder(cart *cartspec.Cart, orderID string) (*cartspec.ReorderResult, error) {
+	// Use the private endpoint, as there's no auth token for service to service calls
+	resp, err := s.client.InvokeMethod(context.Background(), "orders", "private/get/"+orderID, "get")
 	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, ReorderNotFoundError()
+		}
+
 		return nil, err
 	}
 
-	err = s.Clear(&cart)
+	order := &orderspec.Order{}
+	if err := json.Unmarshal(resp, order); err != nil {
+		return nil, err
+	}
+
+	// Don't give away that other users' orders exist
+	if order.ForUserID != cart.ForUserID {
+		return nil, ReorderNotFoundError()
+	}
+
+	result := &cartspec.ReorderResult{Cart: cart, Skipped: []cartspec.SkippedProduct{}}
+	reordered := []orderspec.LineItem{}
+
+	for _, line := range order.LineItems {
+		exists, err := s.productExists(line.Product.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		if !exists {
+			log.Printf("### Product %s on order %s is no longer in the catalog", line.Product.ID, order.ID)
+
+			result.Skipped = append(result.Skipped, cartspec.SkippedProduct{
+				ProductID: line.Product.ID,
+				Name:      line.Product.Name,
+				Count:     line.Count,
+			})
+
+			continue
+		}
+
+		reordered = append(reordered, line)
+	}
+
+	err = s.update(cart, func(c *cartspec.Cart) {
+		for _, line := range reordered {
+			c.Products[line.Product.ID] += line.Count
+		}
+
+		s.limitQuantities(c)
+	})
 	if err != nil {
-		// Log but don't return the error, as the order was published
-		log.Printf("### Warning failed to clear cart %s", err)
+		return nil, err
 	}
 
-	return order, nil
+	return result, nil
 }
 
-// SetProductCount updates the count of a given product in the cart
-func (s CartService) SetProductCount(cart *cartspec.Cart, productID string, count int) error {
-	if count < 0 {
-		return ProductCountError()
+// limitQuantities caps the count of every product at the maximum, for changes that add to existing counts
+func (s CartService) limitQuantities(cart *cartspec.Cart) {
+	if s.maxQuantity <= 0 {
+		return
 	}
 
-	if count == 0 {
-		delete(cart.Products, productID)
-	} else {
-		cart.Products[productID] = count
+	for productID, count := range cart.Products {
+		if count > s.maxQuantity {
+			cart.Products[productID] = s.maxQuantity
+		}
 	}
+}
 
-	// Call Dapr client to save state
-	jsonPayload, err := json.Marshal(cart)
+// productExists checks a product is in the catalog, via a service to service call to the products service
+func (s CartService) productExists(productID string) (bool, error) {
+	_, err := s.client.InvokeMethod(context.Background(), "products", "get/"+productID, "get")
 	if err != nil {
-		return err
+		if status.Code(err) == codes.NotFound {
+			return false, nil
+		}
+
+		return false, ProductLookupError(productID)
+	}
+
+	return true, nil
+}
+
+// update applies a change to a cart and saves it, using the cart's ETag so other changes are never lost
+// When the cart was changed by someone else the latest version is fetched, and the change applied again
+// Unless IfMatch is set, then the change is only saved against that version, and StaleCartError returned if it's gone
+// After saving the cart is refreshed from the state store, so it has the new ETag
+func (s CartService) update(cart *cartspec.Cart, change func(*cartspec.Cart)) error {
+	if cart.IfMatch != "" {
+		cart.ETag = cart.IfMatch
+	}
+
+	for attempt := 1; ; attempt++ {
+		change(cart)
+
+		err := s.save(cart)
+		if err == nil {
+			break
+		}
+
+		if cart.IfMatch != "" && isConflict(err) {
+			return StaleCartError()
+		}
+
+		if !isConflict(err) || attempt >= maxSaveAttempts {
+			return err
+		}
+
+		log.Printf("### Cart for user %s was changed by someone else, retrying", cart.ForUserID)
+		time.Sleep(time.Duration(attempt) * 50 * time.Millisecond)
+
+		latest, err := s.Get(cart.ForUserID)
+		if err != nil {
+			return err
+		}
+
+		*cart = *latest
 	}
 
-	if err = s.client.SaveState(context.Background(), s.storeName, cart.ForUserID, jsonPayload, nil); err != nil {
+	latest, err := s.Get(cart.ForUserID)
+	if err != nil {
 		return err
 	}
 
+	*cart = *latest
+
+	s.trackActivity(*cart)
+
 	return nil
 }
 
-// Clear the cart
-func (s CartService) Clear(cart *cartspec.Cart) error {
-	cart.Products = map[string]int{}
+// save makes a single attempt at saving a cart, which fails if its ETag is out of date
+// Carts expire once they've not been changed for the TTL, if there is one
+func (s CartService) save(cart *cartspec.Cart) error {
+	cart.Updated = time.Now().UTC()
+
 	// Call Dapr client to save state
 	jsonPayload, err := json.Marshal(cart)
 	if err != nil {
 		return err
 	}
 
-	if err = s.client.SaveState(context.Background(), s.storeName, cart.ForUserID, jsonPayload, nil); err != nil {
-		return err
+	var metadata map[string]string
+	if s.ttl > 0 {
+		metadata = map[string]string{"ttlInSeconds": strconv.Itoa(int(s.ttl.Seconds()))}
 	}
 
-	return nil
+	return s.client.SaveStateWithETag(context.Background(), s.storeName, cart.ForUserID, jsonPayload, cart.ETag, metadata,
+		dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
 }
 
-// Scummy but functional ID generator
-func makeID(length int) string {
-	id := ""
-	possible := "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+// reserveOrderID generates a new order ID, and checks it's not been used by saving it to the state store
+// The ID is saved first write wins, so if two carts get the same ID at the same time only one can have it
+func (s CartService) reserveOrderID() (string, error) {
+	metadata := map[string]string{"ttlInSeconds": reservedIDTTL}
 
-	rand.Seed(time.Now().UnixNano())
+	for attempt := 1; attempt <= maxIDAttempts; attempt++ {
+		id := s.ids.NewID()
 
-	for i := 0; i < length; i++ {
-		id += string(possible[rand.Intn(len(possible)-1)])
+		data, err := s.client.GetState(context.Background(), s.storeName, orderIDKey(id), nil)
+		if err != nil {
+			return "", err
+		}
+
+		if data.Value != nil {
+			log.Printf("### Warning order ID %s is already taken, generating another", id)
+			continue
+		}
+
+		err = s.client.SaveState(context.Background(), s.storeName, orderIDKey(id), []byte(time.Now().UTC().Format(time.RFC3339)),
+			metadata, dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
+		if err == nil {
+			return id, nil
+		}
+
+		// Most likely someone else saved the same ID since we checked
+		log.Printf("### Warning unable to reserve order ID %s: %s", id, err)
 	}
 
-	return id
+	return "", OrderIDError()
+}
+
+func orderIDKey(orderID string) string {
+	return "order-id-" + orderID
 }
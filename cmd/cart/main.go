@@ -49,12 +49,17 @@ func main() {
 	// Use chi for routing
 	router := chi.NewRouter()
 
+	svc := impl.NewService(serviceName)
+
 	// Our API wraps a common api.Base instance and a CartService
 	api := API{
 		api.NewBase(serviceName, version, buildInfo, healthy),
-		impl.NewService(serviceName),
+		svc,
 	}
 
+	// Look for abandoned carts in the background
+	go svc.RunAbandonedDetector(1 * time.Minute)
+
 	// Enabling of auth is optional, set via AUTH_CLIENT_ID env var
 	var validator auth.Validator
 
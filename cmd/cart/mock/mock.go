@@ -2,12 +2,16 @@ package mock
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/benc-uk/dapr-store/cmd/cart/impl"
 	cartspec "github.com/benc-uk/dapr-store/cmd/cart/spec"
 	orderspec "github.com/benc-uk/dapr-store/cmd/orders/spec"
+	productspec "github.com/benc-uk/dapr-store/cmd/products/spec"
 )
 
 // CartService mock
@@ -18,6 +22,19 @@ type CartService struct {
 var mockCarts []cartspec.Cart
 var mockOrders []orderspec.Order
 
+// Guest carts keyed on token, with one already in use
+var mockGuests = map[string]*cartspec.Cart{
+	mockGuestToken: {ForUserID: cartspec.GuestPrefix + mockGuestToken, Products: map[string]int{"prd3": 1, "prd4": 5}},
+}
+
+const mockGuestToken = "0123456789abcdef0123456789abcdef"
+
+// Most of any one product allowed in a cart
+const mockMaxQuantity = 99
+
+// Version of the mock carts, which changes every time one of them is saved
+var mockVersion = 1
+
 func init() {
 	mockJSON, err := os.ReadFile("../../testing/mock-data/carts.json")
 	if err != nil {
@@ -44,6 +61,7 @@ func init() {
 func (s CartService) Get(userID string) (*cartspec.Cart, error) {
 	for _, cart := range mockCarts {
 		if cart.ForUserID == userID {
+			cart.ETag = strconv.Itoa(mockVersion)
 			return &cart, nil
 		}
 	}
@@ -52,6 +70,11 @@ func (s CartService) Get(userID string) (*cartspec.Cart, error) {
 	cart.ForUserID = userID
 	cart.Products = make(map[string]int)
 
+	// Users starting "gone" have a product in their cart that has since left the catalog
+	if strings.HasPrefix(userID, "gone") {
+		cart.Products["gone-prd"] = 1
+	}
+
 	return cart, nil
 }
 
@@ -66,25 +89,81 @@ func (s CartService) Submit(cart cartspec.Cart) (*orderspec.Order, error) {
 	return &mockOrders[0], nil
 }
 
+// Price mock, products on the mock order have their real details, all others cost 10
+func (s CartService) Price(cart cartspec.Cart) (*cartspec.PricedCart, error) {
+	products := map[string]productspec.Product{}
+
+	for _, line := range mockOrders[0].LineItems {
+		products[line.Product.ID] = line.Product
+	}
+
+	lineItems := []orderspec.LineItem{}
+
+	for productID, count := range cart.Products {
+		if strings.HasPrefix(productID, "gone") {
+			return nil, impl.ProductNotFoundError(productID)
+		}
+
+		product, exists := products[productID]
+		if !exists {
+			product = productspec.Product{ID: productID, Name: "Mock product " + productID, Cost: 10}
+		}
+
+		lineItems = append(lineItems, orderspec.LineItem{Product: product, Count: count})
+	}
+
+	priced := cartspec.NewPricedCart(cart.ForUserID, lineItems, 20, 10)
+
+	return &priced, nil
+}
+
 // SetProductCount updates the count of a given product in the cart
 func (s CartService) SetProductCount(cart *cartspec.Cart, productID string, count int) error {
 	if count < 0 {
 		return impl.ProductCountError()
 	}
 
+	if count > mockMaxQuantity {
+		return impl.ProductMaxCountError(mockMaxQuantity)
+	}
+
+	// Products with IDs starting "gone" are not in the catalog
+	if count > 0 && strings.HasPrefix(productID, "gone") {
+		return impl.ProductNotFoundError(productID)
+	}
+
+	if stale(cart) {
+		return impl.StaleCartError()
+	}
+
+	mockVersion++
+	cart.ETag = strconv.Itoa(mockVersion)
+
+	// Guest carts are held in mockGuests, all other changes go to the first mock cart
+	products := mockCarts[0].Products
+	if strings.HasPrefix(cart.ForUserID, cartspec.GuestPrefix) {
+		products = cart.Products
+	}
+
 	if count == 0 {
-		delete(mockCarts[0].Products, productID)
+		delete(products, productID)
 		return nil
 	}
 
-	mockCarts[0].Products[productID] = count
+	products[productID] = count
 
 	return nil
 }
 
 // Clear the cart
 func (s CartService) Clear(cart *cartspec.Cart) error {
+	if stale(cart) {
+		return impl.StaleCartError()
+	}
+
 	cart.Products = map[string]int{}
+	mockVersion++
+	cart.ETag = strconv.Itoa(mockVersion)
 
 	for i, c := range mockCarts {
 		if c.ForUserID == cart.ForUserID {
@@ -94,3 +173,89 @@ func (s CartService) Clear(cart *cartspec.Cart) error {
 
 	return nil
 }
+
+// Reorder adds products from a mock order to the cart, products with IDs starting "gone" are skipped
+func (s CartService) Reorder(cart *cartspec.Cart, orderID string) (*cartspec.ReorderResult, error) {
+	if stale(cart) {
+		return nil, impl.StaleCartError()
+	}
+
+	for _, order := range mockOrders {
+		if order.ID != orderID || order.ForUserID != cart.ForUserID {
+			continue
+		}
+
+		result := &cartspec.ReorderResult{Cart: cart, Skipped: []cartspec.SkippedProduct{}}
+
+		for _, line := range order.LineItems {
+			if strings.HasPrefix(line.Product.ID, "gone") {
+				result.Skipped = append(result.Skipped, cartspec.SkippedProduct{ProductID: line.Product.ID, Name: line.Product.Name, Count: line.Count})
+				continue
+			}
+
+			cart.Products[line.Product.ID] += line.Count
+		}
+
+		mockVersion++
+		cart.ETag = strconv.Itoa(mockVersion)
+
+		return result, nil
+	}
+
+	return nil, impl.ReorderNotFoundError()
+}
+
+// NewGuestToken mock, tokens are made from a counter
+func (s CartService) NewGuestToken() string {
+	return fmt.Sprintf("%032x", len(mockGuests)+1)
+}
+
+// GetGuest mock, guest carts are created when first fetched
+func (s CartService) GetGuest(token string) (*cartspec.Cart, error) {
+	if len(token) != 32 {
+		return nil, impl.GuestTokenError()
+	}
+
+	cart, exists := mockGuests[token]
+	if !exists {
+		cart = &cartspec.Cart{ForUserID: cartspec.GuestPrefix + token, Products: map[string]int{}}
+		mockGuests[token] = cart
+	}
+
+	cart.ETag = strconv.Itoa(mockVersion)
+
+	return cart, nil
+}
+
+// Merge mock, the guest cart is removed after merging
+func (s CartService) Merge(cart *cartspec.Cart, token string, rule cartspec.MergeRule) error {
+	if rule == "" {
+		rule = cartspec.MergeSum
+	}
+
+	if !rule.Valid() {
+		return impl.MergeRuleError()
+	}
+
+	if stale(cart) {
+		return impl.StaleCartError()
+	}
+
+	guest, err := s.GetGuest(token)
+	if err != nil {
+		return err
+	}
+
+	cartspec.MergeCarts(cart, *guest, rule)
+	delete(mockGuests, token)
+
+	mockVersion++
+	cart.ETag = strconv.Itoa(mockVersion)
+
+	return nil
+}
+
+// stale checks a change made with If-Match is against the latest version, like saving with an ETag does
+func stale(cart *cartspec.Cart) bool {
+	return cart.IfMatch != "" && cart.IfMatch != strconv.Itoa(mockVersion)
+}
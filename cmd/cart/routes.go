@@ -13,8 +13,10 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/benc-uk/dapr-store/cmd/cart/impl"
+	"github.com/benc-uk/dapr-store/cmd/cart/spec"
 	"github.com/benc-uk/go-rest-api/pkg/auth"
 	"github.com/benc-uk/go-rest-api/pkg/problem"
 	"github.com/go-chi/chi/v5"
@@ -24,14 +26,21 @@ import (
 func (api API) addRoutes(router chi.Router, v auth.Validator) {
 	router.Put("/setProduct/{userId}/{productId}/{count}", v.Protect(api.setProductCount))
 	router.Get("/get/{userId}", v.Protect(api.getCart))
+	router.Get("/priced/{userId}", v.Protect(api.getPricedCart))
 	router.Post("/submit", v.Protect(api.submitCart))
 	router.Put("/clear/{userId}", v.Protect(api.clearCart))
+	router.Put("/reorder/{userId}/{orderId}", v.Protect(api.reorder))
+	router.Put("/merge/{userId}/{token}", v.Protect(api.mergeGuestCart))
+	// Guest carts are for anonymous visitors, so are not protected
+	// The token is random and unguessable, and acts as the key to the cart
+	router.Post("/guest", api.newGuestCart)
+	router.Get("/guest/{token}", api.getGuestCart)
+	router.Put("/guest/{token}/setProduct/{productId}/{count}", api.setGuestProductCount)
+	router.Put("/guest/{token}/clear", api.clearGuestCart)
 }
 
 func (api API) setProductCount(resp http.ResponseWriter, req *http.Request) {
 	userID := chi.URLParam(req, "userId")
-	productID := chi.URLParam(req, "productId")
-	countString := chi.URLParam(req, "count")
 
 	cart, err := api.service.Get(userID)
 	if err != nil {
@@ -40,6 +49,18 @@ func (api API) setProductCount(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	api.setCount(resp, req, cart)
+}
+
+// setCount is the common part of setting a product count, for both user & guest carts
+func (api API) setCount(resp http.ResponseWriter, req *http.Request, cart *spec.Cart) {
+	productID := chi.URLParam(req, "productId")
+	countString := chi.URLParam(req, "count")
+
+	if !checkIfMatch(resp, req, cart) {
+		return
+	}
+
 	count, err := strconv.Atoi(countString)
 	if err != nil {
 		problem.Wrap(400, req.RequestURI, productID, err).Send(resp)
@@ -48,14 +69,14 @@ func (api API) setProductCount(resp http.ResponseWriter, req *http.Request) {
 
 	err = api.service.SetProductCount(cart, productID, count)
 	if err != nil {
-		problem.Wrap(500, req.RequestURI, productID, err).Send(resp)
+		api.sendCartProblem(resp, req, productID, err)
 
 		return
 	}
 
 	resp.Header().Set("Content-Type", "application/json")
 
-	api.ReturnJSON(resp, cart)
+	api.returnCart(resp, cart)
 }
 
 func (api API) getCart(resp http.ResponseWriter, req *http.Request) {
@@ -69,7 +90,29 @@ func (api API) getCart(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	api.ReturnJSON(resp, cart)
+	api.returnCart(resp, cart)
+}
+
+// Get the cart with the products looked up and priced, as it would be if it was submitted
+func (api API) getPricedCart(resp http.ResponseWriter, req *http.Request) {
+	userID := chi.URLParam(req, "userId")
+
+	cart, err := api.service.Get(userID)
+	if err != nil {
+		problem.Wrap(500, req.RequestURI, userID, err).Send(resp)
+
+		return
+	}
+
+	priced, err := api.service.Price(*cart)
+	if err != nil {
+		api.sendCartProblem(resp, req, userID, err)
+
+		return
+	}
+
+	setETag(resp, cart)
+	api.ReturnJSON(resp, priced)
 }
 
 func (api API) clearCart(resp http.ResponseWriter, req *http.Request) {
@@ -82,12 +125,26 @@ func (api API) clearCart(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = api.service.Clear(cart)
+	api.clear(resp, req, cart)
+}
+
+// clear is the common part of clearing a cart, for both user & guest carts
+func (api API) clear(resp http.ResponseWriter, req *http.Request, cart *spec.Cart) {
+	if !checkIfMatch(resp, req, cart) {
+		return
+	}
+
+	err := api.service.Clear(cart)
 	if err != nil {
+		if cartErr, ok := err.(impl.CartError); ok && cartErr.Error() == impl.StaleError {
+			api.sendCartProblem(resp, req, cart.ForUserID, err)
+			return
+		}
+
 		log.Printf("### Warning failed to clear cart %s", err)
 	}
 
-	api.ReturnJSON(resp, cart)
+	api.returnCart(resp, cart)
 }
 
 func (api API) submitCart(resp http.ResponseWriter, req *http.Request) {
@@ -113,12 +170,7 @@ func (api API) submitCart(resp http.ResponseWriter, req *http.Request) {
 
 	order, err := api.service.Submit(*cart)
 	if err != nil {
-		if cartErr, ok := err.(impl.CartError); ok && cartErr.Error() == impl.EmptyError {
-			problem.Wrap(400, req.RequestURI, userID, cartErr).Send(resp)
-			return
-		}
-
-		problem.Wrap(500, req.RequestURI, userID, err).Send(resp)
+		api.sendCartProblem(resp, req, userID, err)
 
 		return
 	}
@@ -126,3 +178,87 @@ func (api API) submitCart(resp http.ResponseWriter, req *http.Request) {
 	// Send the _order_ back, created from submitting the cart
 	api.ReturnJSON(resp, order)
 }
+
+func (api API) reorder(resp http.ResponseWriter, req *http.Request) {
+	userID := chi.URLParam(req, "userId")
+	orderID := chi.URLParam(req, "orderId")
+
+	cart, err := api.service.Get(userID)
+	if err != nil {
+		problem.Wrap(500, req.RequestURI, userID, err).Send(resp)
+
+		return
+	}
+
+	if !checkIfMatch(resp, req, cart) {
+		return
+	}
+
+	result, err := api.service.Reorder(cart, orderID)
+	if err != nil {
+		api.sendCartProblem(resp, req, orderID, err)
+
+		return
+	}
+
+	// Send the cart back, along with anything that couldn't be re-ordered
+	setETag(resp, result.Cart)
+	api.ReturnJSON(resp, result)
+}
+
+// returnCart sends a cart back, with its ETag so the client can make conditional changes to it
+func (api API) returnCart(resp http.ResponseWriter, cart *spec.Cart) {
+	setETag(resp, cart)
+	api.ReturnJSON(resp, cart)
+}
+
+func setETag(resp http.ResponseWriter, cart *spec.Cart) {
+	if cart.ETag != "" {
+		resp.Header().Set("ETag", `"`+cart.ETag+`"`)
+	}
+}
+
+// checkIfMatch checks an If-Match header against the cart, sending a 412 problem when the client's cart is out of date
+// Requests without If-Match are always allowed, and changes are made to the latest cart
+// With If-Match the service is given the ETag, so a change made in the meantime is a 412 rather than being retried
+func checkIfMatch(resp http.ResponseWriter, req *http.Request, cart *spec.Cart) bool {
+	ifMatch := req.Header.Get("If-Match")
+	if ifMatch == "" || ifMatch == "*" {
+		return true
+	}
+
+	for _, etag := range strings.Split(ifMatch, ",") {
+		etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+		if strings.Trim(etag, `"`) == cart.ETag {
+			cart.IfMatch = cart.ETag
+
+			return true
+		}
+	}
+
+	setETag(resp, cart)
+	problem.Wrap(412, req.RequestURI, cart.ForUserID, impl.StaleCartError()).Send(resp)
+
+	return false
+}
+
+// Map errors from pricing & changing carts to problem responses, so every route gives the same status for an error
+func (api API) sendCartProblem(resp http.ResponseWriter, req *http.Request, id string, err error) {
+	status := 500
+
+	if cartErr, ok := err.(impl.CartError); ok {
+		switch {
+		case strings.HasPrefix(cartErr.Error(), impl.ProductMissingPrefix) || cartErr.Error() == impl.ReorderMissingError:
+			status = 404
+		case cartErr.Error() == impl.CountError || strings.HasPrefix(cartErr.Error(), impl.MaxCountPrefix):
+			status = 422
+		case cartErr.Error() == impl.EmptyError || cartErr.Error() == impl.GuestOrderError ||
+			cartErr.Error() == impl.GuestTokenInvalidError || cartErr.Error() == impl.MergeRuleInvalidError:
+			status = 400
+		case cartErr.Error() == impl.StaleError:
+			status = 412
+		}
+	}
+
+	problem.Wrap(status, req.RequestURI, id, err).Send(resp)
+}
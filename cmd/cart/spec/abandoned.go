@@ -0,0 +1,49 @@
+package spec
+
+import (
+	"sort"
+	"time"
+)
+
+// AbandonedCart is published when a user's cart has been left idle for too long, so they can be reminded about it
+type AbandonedCart struct {
+	ForUserID string         `json:"forUserId"`
+	Products  map[string]int `json:"products"`
+	Updated   time.Time      `json:"updated"`
+}
+
+// ActiveCarts tracks when each user's cart was last seen changing, keyed on user ID
+// The times can be behind the carts, but never ahead, so carts that look idle must be checked
+// Only carts with products in are tracked, guest carts are never tracked as there's no one to remind
+type ActiveCarts map[string]time.Time
+
+// Touch records a change to a cart, empty carts stop being tracked
+func (a ActiveCarts) Touch(cart Cart) {
+	if len(cart.Products) == 0 {
+		delete(a, cart.ForUserID)
+		return
+	}
+
+	a[cart.ForUserID] = cart.Updated
+}
+
+// Idle lists the users whose carts haven't changed for longer than the idle duration, longest idle first
+func (a ActiveCarts) Idle(idle time.Duration, now time.Time) []string {
+	userIDs := []string{}
+
+	for userID, updated := range a {
+		if now.Sub(updated) > idle {
+			userIDs = append(userIDs, userID)
+		}
+	}
+
+	sort.Slice(userIDs, func(i, j int) bool {
+		if !a[userIDs[i]].Equal(a[userIDs[j]]) {
+			return a[userIDs[i]].Before(a[userIDs[j]])
+		}
+
+		return userIDs[i] < userIDs[j]
+	})
+
+	return userIDs
+}
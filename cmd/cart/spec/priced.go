@@ -0,0 +1,107 @@
+package spec
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	orderspec "github.com/benc-uk/dapr-store/cmd/orders/spec"
+)
+
+// PricedCart is a cart with the products looked up and priced, it's exactly what the cart would be ordered as
+// Prices include tax, the net & tax amounts are a breakdown of the total
+type PricedCart struct {
+	ForUserID string         `json:"forUserId"`
+	Lines     []PricedLine   `json:"lines"`
+	Discounts []DiscountLine `json:"discounts"`
+	Items     int            `json:"items"`
+	TaxRate   float32        `json:"taxRate"`
+	Discount  float32        `json:"discount"` // Total of all the discounts, already taken off the lines & total
+	Net       float32        `json:"net"`
+	Tax       float32        `json:"tax"`
+	Total     float32        `json:"total"` // Grand total, which is the amount an order for the cart would be
+}
+
+// PricedLine is a product in a priced cart with its count, and the cost of them all
+type PricedLine struct {
+	orderspec.LineItem
+	Net   float32 `json:"net"`
+	Tax   float32 `json:"tax"`
+	Total float32 `json:"total"`
+}
+
+// DiscountLine is money taken off a line of the cart, the line's product cost is already reduced by it
+type DiscountLine struct {
+	ProductID   string  `json:"productId"`
+	Description string  `json:"description"`
+	Amount      float32 `json:"amount"`
+}
+
+// NewPricedCart prices line items for a user's cart, lines are sorted by product ID so the order is always the same
+// Products on offer have offerDiscount percent taken off their cost, shown as a discount line
+func NewPricedCart(userID string, items []orderspec.LineItem, taxRate float32, offerDiscount float32) PricedCart {
+	priced := PricedCart{
+		ForUserID: userID,
+		Lines:     []PricedLine{},
+		Discounts: []DiscountLine{},
+		TaxRate:   taxRate,
+	}
+
+	var discount, net, tax, total float64
+
+	for _, item := range items {
+		// The order gets the reduced cost, so invoices & refunds are for what was actually paid
+		if offerDiscount > 0 && item.Product.OnOffer {
+			full := item.Total()
+			item.Product.Cost = float32(roundPennies(float64(item.Product.Cost) * (1 - float64(offerDiscount)/100)))
+
+			priced.Discounts = append(priced.Discounts, DiscountLine{
+				ProductID:   item.Product.ID,
+				Description: fmt.Sprintf("%g%% off %s, on offer", offerDiscount, item.Product.Name),
+				Amount:      float32(roundPennies(float64(full) - float64(item.Total()))),
+			})
+
+			discount += float64(priced.Discounts[len(priced.Discounts)-1].Amount)
+		}
+
+		line := PricedLine{LineItem: item, Total: item.Total()}
+		line.Net, line.Tax = orderspec.SplitTax(line.Total, taxRate)
+
+		priced.Lines = append(priced.Lines, line)
+		priced.Items += item.Count
+
+		net += float64(line.Net)
+		tax += float64(line.Tax)
+		total += float64(line.Total)
+	}
+
+	sort.Slice(priced.Lines, func(i, j int) bool {
+		return priced.Lines[i].Product.ID < priced.Lines[j].Product.ID
+	})
+
+	sort.Slice(priced.Discounts, func(i, j int) bool {
+		return priced.Discounts[i].ProductID < priced.Discounts[j].ProductID
+	})
+
+	// Summing can leave stray fractions of a penny
+	priced.Discount = float32(roundPennies(discount))
+	priced.Net = float32(roundPennies(net))
+	priced.Tax = float32(roundPennies(tax))
+	priced.Total = float32(roundPennies(total))
+
+	return priced
+}
+
+func roundPennies(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// LineItems are the lines of the priced cart, as they go on an order
+func (p PricedCart) LineItems() []orderspec.LineItem {
+	items := []orderspec.LineItem{}
+	for _, line := range p.Lines {
+		items = append(items, line.LineItem)
+	}
+
+	return items
+}
@@ -1,17 +1,87 @@
 package spec
 
-import "github.com/benc-uk/dapr-store/cmd/orders/spec"
+import (
+	"time"
+
+	"github.com/benc-uk/dapr-store/cmd/orders/spec"
+)
 
 // Cart holds a users shopping cart
 type Cart struct {
 	Products  map[string]int `json:"products"`
 	ForUserID string         `json:"forUserId"`
+	Updated   time.Time      `json:"updated"` // When the cart was last changed, zero if it never has been
+	ETag      string         `json:"-"`       // Version of the cart in the state store, blank if it's never been saved
+	IfMatch   string         `json:"-"`       // Version the client made its change against, set when it must not be retried
+}
+
+// ReorderResult is a cart refilled from a previous order, with any products that couldn't be added
+type ReorderResult struct {
+	Cart    *Cart            `json:"cart"`
+	Skipped []SkippedProduct `json:"skipped"`
+}
+
+// SkippedProduct is a product on a previous order which is no longer in the catalog
+type SkippedProduct struct {
+	ProductID string `json:"productId"`
+	Name      string `json:"name"`
+	Count     int    `json:"count"`
 }
 
 // CartService defines core CRUD methods a cart service should have
 type CartService interface {
 	Get(string) (*Cart, error)
 	Submit(Cart) (*spec.Order, error)
+	Price(Cart) (*PricedCart, error)
 	SetProductCount(*Cart, string, int) error
 	Clear(*Cart) error
+	Reorder(*Cart, string) (*ReorderResult, error)
+	NewGuestToken() string
+	GetGuest(string) (*Cart, error)
+	Merge(*Cart, string, MergeRule) error
+}
+
+// GuestPrefix starts the ForUserID of guest carts, it's followed by the guest's cart token
+const GuestPrefix = "guest-"
+
+// GuestCart is a cart for an anonymous visitor, the token is all that's needed to use it
+type GuestCart struct {
+	Token string `json:"token"`
+	*Cart
+}
+
+// MergeRule decides the count of a product when it's in both carts being merged
+type MergeRule string
+
+const (
+	MergeSum         MergeRule = "sum"   // Add the counts together
+	MergeMax         MergeRule = "max"   // Take the larger count
+	MergePreferGuest MergeRule = "guest" // Take the count from the guest cart
+)
+
+// Valid checks the rule is one we know about
+func (r MergeRule) Valid() bool {
+	return r == MergeSum || r == MergeMax || r == MergePreferGuest
+}
+
+// MergeCarts folds the products of a guest cart into a user's cart, products only in the user's cart are left alone
+func MergeCarts(cart *Cart, guest Cart, rule MergeRule) {
+	if cart.Products == nil {
+		cart.Products = map[string]int{}
+	}
+
+	for productID, count := range guest.Products {
+		existing, inBoth := cart.Products[productID]
+
+		switch {
+		case !inBoth:
+			cart.Products[productID] = count
+		case rule == MergeSum:
+			cart.Products[productID] = existing + count
+		case rule == MergeMax && count > existing:
+			cart.Products[productID] = count
+		case rule == MergePreferGuest:
+			cart.Products[productID] = count
+		}
+	}
 }
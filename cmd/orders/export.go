@@ -0,0 +1,186 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2020
+// Licensed under the MIT License.
+//
+// Bulk export of orders, from the admin API or as a one off CLI command
+// Also the CLI command that backfills the daily index, so older orders are exported
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/benc-uk/dapr-store/cmd/orders/impl"
+	"github.com/benc-uk/dapr-store/cmd/orders/spec"
+	"github.com/benc-uk/go-rest-api/pkg/problem"
+)
+
+// Stream orders as CSV (the default) or NDJSON, filtered with from, to & status query params
+// As the response is streamed, errors part way through can only be logged and the output is cut short
+func (api API) exportOrders(resp http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+
+	format := params.Get("format")
+	if format == "" {
+		format = impl.ExportCSV
+	}
+
+	query, err := exportQuery(params.Get("from"), params.Get("to"), params.Get("status"), format)
+	if err != nil {
+		problem.Wrap(400, req.RequestURI, "export", err).Send(resp)
+		return
+	}
+
+	resp.Header().Set("Content-Type", impl.ExportContentType(format))
+	resp.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="orders.%s"`, format))
+
+	count, err := api.service.ExportOrders(resp, query, format)
+	if err != nil {
+		log.Printf("### Error! Export failed after %d orders: %s", count, err)
+		return
+	}
+
+	log.Printf("### Exported %d orders", count)
+}
+
+// exportQuery checks the export options, dates are as for order history and from is required
+func exportQuery(from, to, status, format string) (spec.OrderQuery, error) {
+	query := spec.OrderQuery{Status: spec.OrderStatus(status)}
+
+	if impl.ExportContentType(format) == "" {
+		return query, fmt.Errorf("format must be %s or %s", impl.ExportCSV, impl.ExportNDJSON)
+	}
+
+	if from == "" {
+		return query, errors.New("a from date is required")
+	}
+
+	var err error
+
+	if query.From, err = parseDate(from, false); err != nil {
+		return query, err
+	}
+
+	if query.To, err = parseDate(to, true); err != nil {
+		return query, err
+	}
+
+	return query, nil
+}
+
+// runExport is the 'export' CLI command, which writes orders to stdout or a file then exits
+// It still needs a Dapr sidecar, e.g. run with 'dapr run --app-id orders -- orders export -from 2023-01-01'
+func runExport(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	from := flags.String("from", "", "Export orders created on or after this date, as YYYY-MM-DD or RFC3339 (required)")
+	to := flags.String("to", "", "Export orders created up to and including this date, default is now")
+	status := flags.String("status", "", "Only export orders with this status")
+	format := flags.String("format", impl.ExportCSV, "Format of the export, csv or ndjson")
+	outFile := flags.String("out", "", "File to write the export to, default is stdout")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	// Logs go to stderr, so they don't end up mixed in with the export
+	log.SetOutput(os.Stderr)
+
+	query, err := exportQuery(*from, *to, *status, *format)
+	if err != nil {
+		log.Printf("### Error! %s", err)
+		flags.Usage()
+
+		return 2
+	}
+
+	var out io.Writer = os.Stdout
+
+	if *outFile != "" {
+		f, err := os.Create(*outFile)
+		if err != nil {
+			log.Printf("### Error! %s", err)
+			return 1
+		}
+		defer f.Close()
+
+		out = f
+	}
+
+	buffered := bufio.NewWriter(out)
+	svc := impl.NewService(serviceName)
+
+	count, err := svc.ExportOrders(buffered, query, *format)
+	if flushErr := buffered.Flush(); err == nil {
+		err = flushErr
+	}
+
+	if err != nil {
+		log.Printf("### Error! Export failed after %d orders: %s", count, err)
+		return 1
+	}
+
+	log.Printf("### Exported %d orders", count)
+
+	return 0
+}
+
+// runBackfill is the 'backfill' CLI command, which adds orders from before the daily index existed to it
+// The state store can't list users, so user IDs are read one per line from a file or stdin
+func runBackfill(args []string) int {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	usersFile := flags.String("users", "", "File listing the user IDs whose orders are backfilled, one per line, default is stdin")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	log.SetOutput(os.Stderr)
+
+	var in io.Reader = os.Stdin
+
+	if *usersFile != "" {
+		f, err := os.Open(*usersFile)
+		if err != nil {
+			log.Printf("### Error! %s", err)
+			return 1
+		}
+		defer f.Close()
+
+		in = f
+	}
+
+	userIDs := []string{}
+	scanner := bufio.NewScanner(in)
+
+	for scanner.Scan() {
+		if userID := strings.TrimSpace(scanner.Text()); userID != "" {
+			userIDs = append(userIDs, userID)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Printf("### Error! %s", err)
+		return 1
+	}
+
+	svc := impl.NewService(serviceName)
+
+	added, err := svc.BackfillDayIndex(userIDs)
+	if err != nil {
+		log.Printf("### Error! Backfill failed after adding %d orders: %s", added, err)
+		return 1
+	}
+
+	log.Printf("### Added %d orders for %d users to the daily index", added, len(userIDs))
+
+	return 0
+}
@@ -0,0 +1,152 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2020
+// Licensed under the MIT License.
+//
+// Dead-lettering of order events that fail, and replaying them once fixed
+// ----------------------------------------------------------------------------
+
+package impl
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/benc-uk/dapr-store/cmd/orders/spec"
+)
+
+// Key in the state store holding all dead-lettered order events
+const deadLettersKey = "orders-deadletters"
+
+// deadLetter publishes a failed order event to the dead-letter topic, and keeps it for replaying later
+func (s *OrderService) deadLetter(eventID string, order spec.Order, reason string) error {
+	if eventID == "" {
+		eventID = order.ID
+	}
+
+	letter := spec.DeadLetter{
+		ID:     eventID,
+		Order:  order,
+		Reason: reason,
+		Failed: time.Now().UTC(),
+	}
+
+	// Replace rather than add, if the same event has somehow failed before
+	err := s.updateDeadLetters(func(letters []spec.DeadLetter) []spec.DeadLetter {
+		return append(withoutDeadLetter(letters, letter.ID), letter)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.client.PublishEvent(context.Background(), s.pubSubName, s.deadLetterTopic, letter); err != nil {
+		return err
+	}
+
+	log.Printf("### Order event %s was dead-lettered: %s", eventID, reason)
+
+	return nil
+}
+
+// GetDeadLetters fetches all dead-lettered order events, oldest first
+func (s *OrderService) GetDeadLetters() ([]spec.DeadLetter, error) {
+	return s.loadDeadLetters()
+}
+
+// ReplayDeadLetter publishes a dead-lettered order back onto the orders topic, and forgets about it
+// A fixed version of the order can be supplied, otherwise the original order is sent as it was
+func (s *OrderService) ReplayDeadLetter(id string, fixed *spec.Order) (*spec.Order, error) {
+	var letter *spec.DeadLetter
+
+	// Taken off the list before publishing, so the same letter can't be replayed twice at once
+	err := s.updateDeadLetters(func(letters []spec.DeadLetter) []spec.DeadLetter {
+		letter = nil
+
+		for i := range letters {
+			if letters[i].ID == id {
+				letter = &letters[i]
+				return withoutDeadLetter(letters, id)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if letter == nil {
+		return nil, DeadLetterNotFoundError()
+	}
+
+	replay := &letter.Order
+	if fixed != nil {
+		replay = fixed
+	}
+
+	if err := s.client.PublishEvent(context.Background(), s.pubSubName, s.ordersTopic, replay); err != nil {
+		// Put it back so it can be replayed again, log as the publish error is the one that matters
+		if err := s.updateDeadLetters(func(letters []spec.DeadLetter) []spec.DeadLetter {
+			return append(withoutDeadLetter(letters, id), *letter)
+		}); err != nil {
+			log.Printf("### Error!, dead letter %s was lost after failing to replay: %s", id, err)
+		}
+
+		return nil, err
+	}
+
+	log.Printf("### Dead letter %s was replayed as order %s", id, replay.ID)
+
+	return replay, nil
+}
+
+func (s *OrderService) loadDeadLetters() ([]spec.DeadLetter, error) {
+	data, err := s.client.GetState(context.Background(), s.storeName, deadLettersKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	letters := []spec.DeadLetter{}
+
+	if data.Value == nil {
+		return letters, nil
+	}
+
+	if err := json.Unmarshal(data.Value, &letters); err != nil {
+		return nil, err
+	}
+
+	return letters, nil
+}
+
+// updateDeadLetters changes the dead letters with an ETag, change returns the new list or nil to leave it
+func (s *OrderService) updateDeadLetters(change func([]spec.DeadLetter) []spec.DeadLetter) error {
+	return s.updateState(deadLettersKey, func(current []byte) (interface{}, bool, error) {
+		letters := []spec.DeadLetter{}
+
+		if current != nil {
+			if err := json.Unmarshal(current, &letters); err != nil {
+				return nil, false, err
+			}
+		}
+
+		if changed := change(letters); changed != nil {
+			return changed, true, nil
+		}
+
+		return nil, false, nil
+	})
+}
+
+func withoutDeadLetter(letters []spec.DeadLetter, id string) []spec.DeadLetter {
+	kept := []spec.DeadLetter{}
+
+	for _, l := range letters {
+		if l.ID != id {
+			kept = append(kept, l)
+		}
+	}
+
+	return kept
+}
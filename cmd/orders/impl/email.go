@@ -0,0 +1,144 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2020
+// Licensed under the MIT License.
+//
+// Rendering of order emails from templates, as plain text and HTML
+// ----------------------------------------------------------------------------
+
+package impl
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/benc-uk/dapr-store/cmd/orders/spec"
+	userspec "github.com/benc-uk/dapr-store/cmd/users/spec"
+)
+
+// Default templates, used when no template directory is configured
+//
+//go:embed templates/email
+var defaultEmailTemplates embed.FS
+
+// Email is a rendered email, with alternative plain text and HTML bodies
+type Email struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// EmailRenderer renders emails for orders, each order status has its own templates
+// A status has a <status>.txt and <status>.html template, both are parsed along with layout.txt and layout.html
+// The text template must define a "subject" template
+type EmailRenderer struct {
+	templates fs.FS
+	currency  string
+}
+
+// The data passed to email templates
+type emailData struct {
+	Order spec.Order
+	User  userspec.User
+}
+
+// NewEmailRenderer creates an EmailRenderer, loading templates from a directory or using the defaults when blank
+func NewEmailRenderer(templateDir string, currency string) *EmailRenderer {
+	var templates fs.FS = os.DirFS(templateDir)
+
+	if templateDir == "" {
+		templates, _ = fs.Sub(defaultEmailTemplates, "templates/email")
+	}
+
+	return &EmailRenderer{templates, currency}
+}
+
+// HasTemplate checks if there is an email for an order status
+func (r *EmailRenderer) HasTemplate(status spec.OrderStatus) bool {
+	_, err := fs.Stat(r.templates, string(status)+".html")
+	return err == nil
+}
+
+// Render creates the email for an order, based on its current status
+func (r *EmailRenderer) Render(order spec.Order, user userspec.User) (*Email, error) {
+	if !r.HasTemplate(order.Status) {
+		return nil, fmt.Errorf("no email template for order status '%s'", order.Status)
+	}
+
+	data := emailData{order, user}
+	funcs := map[string]interface{}{
+		"money": func(amount float32) string {
+			return fmt.Sprintf("%s%.2f", r.currency, amount)
+		},
+		"lineTotal": func(line spec.LineItem) float32 {
+			return line.Product.Cost * float32(line.Count)
+		},
+	}
+
+	textTmpl, err := texttemplate.New("").Funcs(funcs).ParseFS(r.templates, "layout.txt", string(order.Status)+".txt")
+	if err != nil {
+		return nil, err
+	}
+
+	// Using html/template means anything in the order or user is escaped properly
+	htmlTmpl, err := htmltemplate.New("").Funcs(funcs).ParseFS(r.templates, "layout.html", string(order.Status)+".html")
+	if err != nil {
+		return nil, err
+	}
+
+	subject, text, html := &strings.Builder{}, &strings.Builder{}, &strings.Builder{}
+
+	if err := textTmpl.ExecuteTemplate(subject, "subject", data); err != nil {
+		return nil, err
+	}
+
+	if err := textTmpl.ExecuteTemplate(text, string(order.Status)+".txt", data); err != nil {
+		return nil, err
+	}
+
+	if err := htmlTmpl.ExecuteTemplate(html, string(order.Status)+".html", data); err != nil {
+		return nil, err
+	}
+
+	return &Email{
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    strings.TrimSpace(text.String()),
+		HTML:    strings.TrimSpace(html.String()),
+	}, nil
+}
+
+// Multipart creates a multipart/alternative MIME body holding both the text and HTML, and its content type
+func (e Email) Multipart() ([]byte, string, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	// Plain text first, as the last part is the preferred one
+	parts := []struct{ contentType, content string }{
+		{"text/plain; charset=UTF-8", e.Text},
+		{"text/html; charset=UTF-8", e.HTML},
+	}
+
+	for _, p := range parts {
+		part, err := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {p.contentType}})
+		if err != nil {
+			return nil, "", err
+		}
+
+		if _, err := part.Write([]byte(p.content)); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+
+	return body.Bytes(), "multipart/alternative; boundary=" + writer.Boundary(), nil
+}
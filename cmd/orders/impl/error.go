@@ -7,8 +7,17 @@
 
 package impl
 
+import (
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
 const NotFoundError = "order not found"
 const StatusError = "order status invalid"
+const DuplicateError = "order already processed"
+const DeadLetterMissingError = "dead letter not found"
 
 type OrdersError struct {
 	err string
@@ -23,5 +32,94 @@ func OrderNotFoundError() OrdersError {
 }
 
 func OrderStatusError() OrdersError {
-	return OrdersError{NotFoundError}
+	return OrdersError{StatusError}
+}
+
+func OrderDuplicateError() OrdersError {
+	return OrdersError{DuplicateError}
+}
+
+func DeadLetterNotFoundError() OrdersError {
+	return OrdersError{DeadLetterMissingError}
+}
+
+const ReturnMissingError = "return not found"
+const ReturnInvalidPrefix = "return invalid: "
+const ReturnResolvedError = "return already resolved"
+
+func ReturnNotFoundError() OrdersError {
+	return OrdersError{ReturnMissingError}
+}
+
+func ReturnInvalidError(reason string) OrdersError {
+	return OrdersError{ReturnInvalidPrefix + reason}
+}
+
+func ReturnStatusError() OrdersError {
+	return OrdersError{ReturnResolvedError}
+}
+
+const PaymentErrorPrefix = "payment failed: "
+
+func PaymentFailedError(reason string) OrdersError {
+	return OrdersError{PaymentErrorPrefix + reason}
+}
+
+const WebhookMissingError = "webhook not found"
+const WebhookInvalidPrefix = "webhook invalid: "
+
+func WebhookNotFoundError() OrdersError {
+	return OrdersError{WebhookMissingError}
+}
+
+func WebhookInvalidError(reason string) OrdersError {
+	return OrdersError{WebhookInvalidPrefix + reason}
+}
+
+const InvoiceUnpaidError = "order has not been paid, no invoice is available"
+
+func InvoiceUnavailableError() OrdersError {
+	return OrdersError{InvoiceUnpaidError}
+}
+
+const ExportInvalidPrefix = "export invalid: "
+
+func ExportInvalidError(reason string) OrdersError {
+	return OrdersError{ExportInvalidPrefix + reason}
+}
+
+const ShipmentInvalidPrefix = "shipment invalid: "
+
+func ShipmentInvalidError(reason string) OrdersError {
+	return OrdersError{ShipmentInvalidPrefix + reason}
+}
+
+const ChangedError = "order was changed by someone else, try again"
+
+func OrderChangedError() OrdersError {
+	return OrdersError{ChangedError}
+}
+
+const RefundErrorPrefix = "refund failed: "
+
+func RefundFailedError(reason string) OrdersError {
+	return OrdersError{RefundErrorPrefix + reason}
+}
+
+const NotHeldError = "order is not on hold"
+
+func OrderNotHeldError() OrdersError {
+	return OrdersError{NotHeldError}
+}
+
+// How many times to try saving state that is being changed concurrently
+const maxSaveAttempts = 5
+
+// isConflict checks for an ETag mismatch from the Dapr state store, i.e. the state was changed by someone else
+func isConflict(err error) bool {
+	if status.Code(err) == codes.Aborted {
+		return true
+	}
+
+	return strings.Contains(strings.ToLower(err.Error()), "etag mismatch")
 }
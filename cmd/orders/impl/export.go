@@ -0,0 +1,262 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2020
+// Licensed under the MIT License.
+//
+// Bulk export of orders, streamed as CSV or NDJSON
+// ----------------------------------------------------------------------------
+
+package impl
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/benc-uk/dapr-store/cmd/orders/spec"
+)
+
+// Supported export formats
+const (
+	ExportCSV    = "csv"
+	ExportNDJSON = "ndjson"
+)
+
+// How many orders are fetched from the state store at once when exporting
+const exportBatchSize = 50
+
+// ExportContentType is the content type of an export format, blank if the format isn't supported
+func ExportContentType(format string) string {
+	switch format {
+	case ExportCSV:
+		return "text/csv"
+	case ExportNDJSON:
+		return "application/x-ndjson"
+	}
+
+	return ""
+}
+
+// ExportOrders writes all orders matching the query to w, with a row for every line item
+// Orders are found through the daily index, a day at a time and in batches, so only a small number are held in memory
+// The query must have a From date, when To is zero orders up to now are exported. Paging in the query is ignored
+// Returns the number of orders written, if there's an error part way through the output will be incomplete
+func (s *OrderService) ExportOrders(w io.Writer, query spec.OrderQuery, format string) (int, error) {
+	if ExportContentType(format) == "" {
+		return 0, ExportInvalidError("format must be " + ExportCSV + " or " + ExportNDJSON)
+	}
+
+	if query.From.IsZero() {
+		return 0, ExportInvalidError("a from date is required")
+	}
+
+	to := query.To
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+
+	rows := NewExportWriter(w, format)
+	if err := rows.Header(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	day := query.From.UTC().Truncate(24 * time.Hour)
+
+	for ; day.Before(to); day = day.AddDate(0, 0, 1) {
+		orderIDs, err := s.loadIndex(dayIndexKey(day))
+		if err != nil {
+			return count, err
+		}
+
+		for start := 0; start < len(orderIDs); start += exportBatchSize {
+			end := start + exportBatchSize
+			if end > len(orderIDs) {
+				end = len(orderIDs)
+			}
+
+			items, err := s.client.GetBulkState(context.Background(), s.storeName, orderIDs[start:end], nil, 10)
+			if err != nil {
+				return count, err
+			}
+
+			for _, item := range items {
+				if item.Error != "" || item.Value == nil {
+					log.Printf("### Warning order %s could not be fetched for export %s", item.Key, item.Error)
+					continue
+				}
+
+				order := spec.Order{}
+				if err := json.Unmarshal(item.Value, &order); err != nil {
+					log.Printf("### Warning order %s is corrupt and was not exported %s", item.Key, err)
+					continue
+				}
+
+				if !query.Matches(order) {
+					continue
+				}
+
+				for _, row := range spec.ExportRows(order) {
+					if err := rows.Write(row); err != nil {
+						return count, err
+					}
+				}
+
+				count++
+			}
+
+			// Push each batch out, so a slow export still streams
+			if err := rows.Flush(); err != nil {
+				return count, err
+			}
+		}
+	}
+
+	return count, rows.Flush()
+}
+
+// BackfillDayIndex adds the orders of the given users to the daily index, which is how exports find orders
+// Orders placed before the daily index existed are only in the index for the user, so are missing from exports until
+// this has been run for their users. The state store can't list users so their IDs must be given, and it's safe to
+// run more than once. Returns the number of orders that were added to the daily index
+func (s *OrderService) BackfillDayIndex(userIDs []string) (int, error) {
+	added := 0
+
+	for _, userID := range userIDs {
+		orderIDs, err := s.GetOrdersForUser(userID)
+		if err != nil {
+			return added, err
+		}
+
+		for start := 0; start < len(orderIDs); start += exportBatchSize {
+			end := start + exportBatchSize
+			if end > len(orderIDs) {
+				end = len(orderIDs)
+			}
+
+			items, err := s.client.GetBulkState(context.Background(), s.storeName, orderIDs[start:end], nil, 10)
+			if err != nil {
+				return added, err
+			}
+
+			for _, item := range items {
+				order := spec.Order{}
+				if item.Error != "" || item.Value == nil || json.Unmarshal(item.Value, &order) != nil || order.Created.IsZero() {
+					log.Printf("### Warning order %s for user %s can't be added to the daily index %s", item.Key, userID, item.Error)
+					continue
+				}
+
+				indexed := false
+
+				err := s.updateState(dayIndexKey(order.Created), func(current []byte) (interface{}, bool, error) {
+					dayOrderIDs := []string{}
+
+					if current != nil {
+						if err := json.Unmarshal(current, &dayOrderIDs); err != nil {
+							return nil, false, err
+						}
+					}
+
+					for _, id := range dayOrderIDs {
+						if id == order.ID {
+							indexed = false
+							return nil, false, nil
+						}
+					}
+
+					indexed = true
+
+					return append(dayOrderIDs, order.ID), true, nil
+				})
+				if err != nil {
+					return added, err
+				}
+
+				if indexed {
+					added++
+				}
+			}
+		}
+	}
+
+	return added, nil
+}
+
+func (s *OrderService) loadIndex(key string) ([]string, error) {
+	data, err := s.client.GetState(context.Background(), s.storeName, key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	orderIDs := []string{}
+
+	if data.Value == nil {
+		return orderIDs, nil
+	}
+
+	if err := json.Unmarshal(data.Value, &orderIDs); err != nil {
+		return nil, err
+	}
+
+	return orderIDs, nil
+}
+
+// ExportWriter writes export rows in one of the formats
+type ExportWriter struct {
+	out     io.Writer
+	csv     *csv.Writer
+	encoder *json.Encoder
+}
+
+// NewExportWriter creates an ExportWriter, any format other than CSV is written as NDJSON
+func NewExportWriter(w io.Writer, format string) *ExportWriter {
+	if format == ExportCSV {
+		return &ExportWriter{out: w, csv: csv.NewWriter(w)}
+	}
+
+	return &ExportWriter{out: w, encoder: json.NewEncoder(w)}
+}
+
+// Header writes the column names, only CSV has a header
+func (r *ExportWriter) Header() error {
+	if r.csv == nil {
+		return nil
+	}
+
+	return r.csv.Write([]string{
+		"orderId", "title", "forUser", "status", "created", "amount", "paymentRef",
+		"productId", "productName", "count", "unitPrice", "lineTotal",
+	})
+}
+
+// Write writes a single row
+func (r *ExportWriter) Write(row spec.ExportRow) error {
+	if r.csv == nil {
+		return r.encoder.Encode(row)
+	}
+
+	return r.csv.Write([]string{
+		row.OrderID, row.Title, row.ForUserID, string(row.Status), row.Created.Format(time.RFC3339), money(row.Amount), row.PaymentRef,
+		row.ProductID, row.ProductName, strconv.Itoa(row.Count), money(row.UnitPrice), money(row.LineTotal),
+	})
+}
+
+// Flush pushes out anything buffered, including through to the client when writing an HTTP response
+func (r *ExportWriter) Flush() error {
+	if r.csv != nil {
+		r.csv.Flush()
+
+		if err := r.csv.Error(); err != nil {
+			return err
+		}
+	}
+
+	if flusher, ok := r.out.(interface{ Flush() }); ok {
+		flusher.Flush()
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2020
+// Licensed under the MIT License.
+//
+// Fraud screening of new orders, and manual review of those put on hold
+// ----------------------------------------------------------------------------
+
+package impl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/benc-uk/dapr-store/cmd/orders/spec"
+)
+
+// Key in the state store holding the IDs of all orders on hold
+const heldOrdersKey = "orders-held"
+
+// screenOrder checks a new order against the fraud rules, giving the reasons it should be held, if any
+func (s *OrderService) screenOrder(order spec.Order) []string {
+	recent := 0
+
+	if s.fraudRules.MaxOrdersPerHour > 0 {
+		// The order itself isn't counted, as the end of the query is exclusive
+		page, err := s.GetOrderHistory(order.ForUserID, spec.OrderQuery{
+			From: order.Created.Add(-time.Hour),
+			To:   order.Created,
+			Page: 1,
+			Size: 1,
+		})
+		if err != nil {
+			log.Printf("### Warning unable to count recent orders for user %s: %s", order.ForUserID, err)
+		} else {
+			recent = page.Total
+		}
+	}
+
+	return s.fraudRules.Screen(order, recent)
+}
+
+// holdOrder puts an order on hold for manual review, no payment is taken until it is released
+func (s *OrderService) holdOrder(order *spec.Order, reasons []string) error {
+	order.HoldReasons = reasons
+
+	if err := s.SetStatus(order, spec.OrderOnHold); err != nil {
+		return err
+	}
+
+	err := s.updateHeldOrders(func(orderIDs []string) []string {
+		for _, id := range orderIDs {
+			if id == order.ID {
+				return nil
+			}
+		}
+
+		return append(orderIDs, order.ID)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("### Order %s was put on hold: %v", order.ID, reasons)
+
+	return nil
+}
+
+// GetHeldOrders fetches all orders on hold waiting for review, oldest first
+func (s *OrderService) GetHeldOrders() ([]spec.Order, error) {
+	orderIDs, err := s.loadIndex(heldOrdersKey)
+	if err != nil {
+		return nil, err
+	}
+
+	orders := []spec.Order{}
+
+	if len(orderIDs) == 0 {
+		return orders, nil
+	}
+
+	items, err := s.client.GetBulkState(context.Background(), s.storeName, orderIDs, nil, 10)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		if item.Error != "" {
+			return nil, fmt.Errorf("held order %s could not be fetched: %s", item.Key, item.Error)
+		}
+
+		if item.Value == nil {
+			log.Printf("### Warning held order %s no longer exists", item.Key)
+			continue
+		}
+
+		order := spec.Order{}
+		if err := json.Unmarshal(item.Value, &order); err != nil {
+			return nil, err
+		}
+
+		orders = append(orders, order)
+	}
+
+	return orders, nil
+}
+
+// ReviewOrder releases or rejects an order on hold
+// Released orders carry on as if they had passed screening, rejected orders are cancelled
+func (s *OrderService) ReviewOrder(orderID string, release bool) (*spec.Order, error) {
+	order, err := s.GetOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if order.Status != spec.OrderOnHold {
+		return nil, OrderNotHeldError()
+	}
+
+	// Releasing claims the order with its ETag before charging it, so releasing it twice at once can't charge it twice
+	if release {
+		log.Printf("### Order %s was released from hold", order.ID)
+
+		if err := s.acceptOrder(order); err != nil {
+			return nil, err
+		}
+	} else {
+		log.Printf("### Order %s was rejected by review", order.ID)
+
+		if order, err = s.CancelOrder(orderID); err != nil {
+			return nil, err
+		}
+	}
+
+	// Log but don't return the error, as the order was reviewed
+	if err := s.removeHeldOrder(order.ID); err != nil {
+		log.Printf("### Warning failed to remove order %s from held orders: %s", order.ID, err)
+	}
+
+	return order, nil
+}
+
+// removeHeldOrder takes an order off the list of held orders
+func (s *OrderService) removeHeldOrder(orderID string) error {
+	return s.updateHeldOrders(func(orderIDs []string) []string {
+		kept := []string{}
+
+		for _, id := range orderIDs {
+			if id != orderID {
+				kept = append(kept, id)
+			}
+		}
+
+		return kept
+	})
+}
+
+// updateHeldOrders changes the list of held orders with an ETag, change returns the new list or nil to leave it
+func (s *OrderService) updateHeldOrders(change func([]string) []string) error {
+	return s.updateState(heldOrdersKey, func(current []byte) (interface{}, bool, error) {
+		orderIDs := []string{}
+
+		if current != nil {
+			if err := json.Unmarshal(current, &orderIDs); err != nil {
+				return nil, false, err
+			}
+		}
+
+		if changed := change(orderIDs); changed != nil {
+			return changed, true, nil
+		}
+
+		return nil, false, nil
+	})
+}
@@ -3,8 +3,12 @@ package impl
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/benc-uk/dapr-store/cmd/orders/spec"
@@ -19,16 +23,67 @@ import (
 type OrderService struct {
 	storeName        string // Name of Dapr state store
 	emailOutputName  string // Name of Dapr output binding for email
+	emailMultipart   bool   // Send emails as multipart text & HTML, rather than just HTML
 	reportOutputName string // Name of Dapr output binding for order reports
+	pubSubName       string // Name of Dapr pub/sub component for order events
+	cancelledTopic   string // Name of Dapr pub/sub topic for cancelled orders
+	statusTopic      string // Name of Dapr pub/sub topic for order status changes
+	ordersTopic      string // Name of Dapr pub/sub topic for new orders
+	deadLetterTopic  string // Name of Dapr pub/sub topic for orders that failed
 	serviceName      string
 	client           dapr.Client
+
+	emails          *EmailRenderer
+	currency        string
+	seller          spec.Seller // Details of the business shown on invoices
+	taxRate         float32     // Percentage of tax included in all prices
+	reports         ReportRenderer
+	payments        spec.PaymentProvider
+	paymentTimeout  time.Duration   // How long to wait for the payment provider
+	fraudRules      spec.FraudRules // Orders breaking any of these are held for review
+	processingDelay time.Duration   // How long until a received order moves to processing
+	deliveryDelay   time.Duration   // How long until a shipped order is (pretend) delivered
+	completeDelay   time.Duration   // How long until a delivered order moves to complete
+
+	watchers  map[string][]chan spec.Order // Channels of those watching for order changes, keyed on order ID
+	pollers   map[string]chan struct{}     // Closed to stop polling an order, once no one is watching it
+	watchPoll time.Duration                // How often watched orders are fetched, to see changes made elsewhere
+	watchLock sync.Mutex
 }
 
 // NewService creates a new OrderService
 func NewService(serviceName string) *OrderService {
 	storeName := env.GetEnvString("DAPR_STORE_NAME", "statestore")
 	emailOutName := env.GetEnvString("DAPR_EMAIL_NAME", "orders-email")
+	emailMultipart := env.GetEnvBool("EMAIL_MULTIPART", false)
+	emailTemplateDir := env.GetEnvString("EMAIL_TEMPLATE_DIR", "")
+	currency := env.GetEnvString("CURRENCY_SYMBOL", "£")
 	reportOutName := env.GetEnvString("DAPR_REPORT_NAME", "orders-report")
+	reportFormat := env.GetEnvString("REPORT_FORMAT", ReportJSON)
+	sellerName := env.GetEnvString("SELLER_NAME", "Dapr Store")
+	sellerAddress := env.GetEnvString("SELLER_ADDRESS", "1 Microservice Way, Cloud City, DA9 9PR")
+	sellerEmail := env.GetEnvString("SELLER_EMAIL", "")
+	sellerTaxID := env.GetEnvString("SELLER_TAX_ID", "")
+
+	taxRate, err := strconv.ParseFloat(env.GetEnvString("TAX_RATE", "20"), 32)
+	if err != nil {
+		log.Printf("### Warning TAX_RATE is not a number, using 20%%")
+
+		taxRate = 20
+	}
+	pubSubName := env.GetEnvString("DAPR_PUBSUB_NAME", "pubsub")
+	cancelledTopic := env.GetEnvString("DAPR_CANCELLED_TOPIC", "orders-cancelled")
+	statusTopic := env.GetEnvString("DAPR_STATUS_TOPIC", "orders-status")
+	ordersTopic := env.GetEnvString("DAPR_ORDERS_TOPIC", "orders-queue")
+	deadLetterTopic := env.GetEnvString("DAPR_DEADLETTER_TOPIC", "orders-deadletter")
+	paymentMode := env.GetEnvString("PAYMENT_FAKE_MODE", PaymentApprove)
+	paymentTimeout := env.GetEnvInt("PAYMENT_TIMEOUT", 10)
+	fraudMaxAmount := env.GetEnvInt("FRAUD_MAX_AMOUNT", 1000)
+	fraudMaxOrdersPerHour := env.GetEnvInt("FRAUD_MAX_ORDERS_PER_HOUR", 5)
+	fraudMaxQuantity := env.GetEnvInt("FRAUD_MAX_QUANTITY", 20)
+	processingDelay := env.GetEnvInt("ORDER_PROCESSING_DELAY", 30)
+	deliveryDelay := env.GetEnvInt("ORDER_DELIVERY_DELAY", 120)
+	completeDelay := env.GetEnvInt("ORDER_COMPLETE_DELAY", 120)
 
 	// Set up Dapr client & checks for Dapr sidecar, otherwise die
 	client, err := dapr.NewClient()
@@ -37,64 +92,188 @@ func NewService(serviceName string) *OrderService {
 	}
 
 	service := &OrderService{
-		storeName,
-		emailOutName,
-		reportOutName,
-		serviceName,
-		client,
+		storeName:        storeName,
+		emailOutputName:  emailOutName,
+		emailMultipart:   emailMultipart,
+		reportOutputName: reportOutName,
+		pubSubName:       pubSubName,
+		cancelledTopic:   cancelledTopic,
+		statusTopic:      statusTopic,
+		ordersTopic:      ordersTopic,
+		deadLetterTopic:  deadLetterTopic,
+		serviceName:      serviceName,
+		client:           client,
+		emails:           NewEmailRenderer(emailTemplateDir, currency),
+		currency:         currency,
+		seller: spec.Seller{
+			Name:    sellerName,
+			Address: splitList(sellerAddress),
+			Email:   sellerEmail,
+			TaxID:   sellerTaxID,
+		},
+		taxRate:        float32(taxRate),
+		reports:        NewReportRenderer(reportFormat),
+		payments:       NewFakePaymentProvider(paymentMode),
+		paymentTimeout: time.Duration(paymentTimeout) * time.Second,
+		fraudRules: spec.FraudRules{
+			MaxAmount:        float32(fraudMaxAmount),
+			MaxOrdersPerHour: fraudMaxOrdersPerHour,
+			MaxQuantity:      fraudMaxQuantity,
+		},
+		processingDelay: time.Duration(processingDelay) * time.Second,
+		deliveryDelay:   time.Duration(deliveryDelay) * time.Second,
+		completeDelay:   time.Duration(completeDelay) * time.Second,
+		watchers:        map[string][]chan spec.Order{},
+		pollers:         map[string]chan struct{}{},
+		watchPoll:       watchPollInterval,
 	}
 
 	return service
 }
 
-// AddOrder stores an order in Dapr state store
+// AddOrder stores an order in Dapr state store, along with adding it to the index of orders for the user & the day
+// All are written in a single transaction, and the indexes use ETags so concurrent orders don't clobber them
 func (s *OrderService) AddOrder(order spec.Order) error {
-	jsonPayload, err := json.Marshal(order)
+	orderPayload, err := json.Marshal(order)
 	if err != nil {
 		return err
 	}
 
-	if err := s.client.SaveState(context.Background(), s.storeName, order.ID, jsonPayload, nil); err != nil {
-		return err
+	for attempt := 1; ; attempt++ {
+		err = s.saveOrderAndIndex(order, orderPayload)
+		if err == nil || !isConflict(err) {
+			return err
+		}
+
+		if attempt >= maxSaveAttempts {
+			log.Printf("### Error!, gave up saving order lists for order '%s' after %d attempts", order.ID, attempt)
+			return err
+		}
+
+		log.Printf("### Order lists for order '%s' changed while saving, retrying", order.ID)
+		time.Sleep(time.Duration(attempt) * 50 * time.Millisecond)
 	}
+}
 
-	// This is a list of orderIDs for the user
-	userOrders := []string{}
+// saveOrderAndIndex makes a single attempt at transactionally saving an order, the user's order index and the daily index
+func (s *OrderService) saveOrderAndIndex(order spec.Order, orderPayload []byte) error {
 	// NOTE We use the userID as a key in the orders state set, to hold an index of orders
-	data, err := s.client.GetState(context.Background(), s.storeName, order.ForUserID, nil)
+	userIndex, alreadyExists, err := s.indexItem(order.ForUserID, order.ID)
 	if err != nil {
 		return err
 	}
 
-	// Ignore any problem, it's possible it doesn't exist yet (user's first order)
-	_ = json.Unmarshal(data.Value, &userOrders)
+	if alreadyExists {
+		log.Printf("### Warning, duplicate order '%s' for user '%s' detected", order.ID, order.ForUserID)
+	}
+
+	dayIndex, _, err := s.indexItem(dayIndexKey(order.Created), order.ID)
+	if err != nil {
+		return err
+	}
+
+	// The order must not exist yet, so two replicas handling the same event can't both add it
+	orderItem := &dapr.SetStateItem{
+		Key:     order.ID,
+		Value:   orderPayload,
+		Options: &dapr.StateOptions{Concurrency: dapr.StateConcurrencyFirstWrite, Consistency: dapr.StateConsistencyStrong},
+	}
+
+	ops := []*dapr.StateOperation{
+		{Type: dapr.StateOperationTypeUpsert, Item: orderItem},
+		{Type: dapr.StateOperationTypeUpsert, Item: userIndex},
+		{Type: dapr.StateOperationTypeUpsert, Item: dayIndex},
+	}
+
+	return s.client.ExecuteStateTransaction(context.Background(), s.storeName, nil, ops)
+}
+
+// indexItem reads a list of orderIDs held under a key, and creates the item to save it back with the order added
+// The item uses the ETag of the list, so the save fails if the list was changed by someone else in the meantime
+func (s *OrderService) indexItem(key string, orderID string) (*dapr.SetStateItem, bool, error) {
+	orderIDs := []string{}
+
+	data, err := s.client.GetState(context.Background(), s.storeName, key, nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Ignore any problem, it's possible it doesn't exist yet (e.g. user's first order)
+	_ = json.Unmarshal(data.Value, &orderIDs)
 
 	alreadyExists := false
 
-	for _, oid := range userOrders {
-		if order.ID == oid {
+	for _, oid := range orderIDs {
+		if orderID == oid {
 			alreadyExists = true
 		}
 	}
 
 	if !alreadyExists {
-		userOrders = append(userOrders, order.ID)
-	} else {
-		log.Printf("### Warning, duplicate order '%s' for user '%s' detected", order.ID, order.ForUserID)
+		orderIDs = append(orderIDs, orderID)
 	}
 
-	// Save updated order list back, again keyed using user id
-	jsonPayload, err = json.Marshal(userOrders)
+	payload, err := json.Marshal(orderIDs)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 
-	if err := s.client.SaveState(context.Background(), s.storeName, order.ForUserID, jsonPayload, nil); err != nil {
-		log.Printf("### Error!, unable to save order list for user '%s'", order.ForUserID)
-		return err
+	// First write wins on the index, with no ETag this means it must not exist yet
+	item := &dapr.SetStateItem{
+		Key:   key,
+		Value: payload,
+		Options: &dapr.StateOptions{
+			Concurrency: dapr.StateConcurrencyFirstWrite,
+			Consistency: dapr.StateConsistencyStrong,
+		},
 	}
 
-	return nil
+	if data.Etag != "" {
+		item.Etag = &dapr.ETag{Value: data.Etag}
+	}
+
+	return item, alreadyExists, nil
+}
+
+// updateState makes a read-modify-write of the JSON value under a key, safe with many replicas doing the same
+// change gets the current value (nil if there isn't one) and returns the new value, and false if it's left as it is
+// The save uses the ETag of what was read and is retried on a conflict, so change may be called more than once
+func (s *OrderService) updateState(key string, change func(current []byte) (interface{}, bool, error)) error {
+	for attempt := 1; ; attempt++ {
+		data, err := s.client.GetState(context.Background(), s.storeName, key, nil)
+		if err != nil {
+			return err
+		}
+
+		value, save, err := change(data.Value)
+		if err != nil || !save {
+			return err
+		}
+
+		jsonPayload, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		err = s.client.SaveStateWithETag(context.Background(), s.storeName, key, jsonPayload, data.Etag, nil,
+			dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
+		if err == nil || !isConflict(err) {
+			return err
+		}
+
+		if attempt >= maxSaveAttempts {
+			log.Printf("### Error!, gave up saving '%s' after %d attempts", key, attempt)
+			return err
+		}
+
+		log.Printf("### State '%s' changed while saving, retrying", key)
+		time.Sleep(time.Duration(attempt) * 50 * time.Millisecond)
+	}
+}
+
+// Orders are also indexed by the day they were created, so they can be found without knowing the user
+func dayIndexKey(created time.Time) string {
+	return "orders-day-" + created.UTC().Format("2006-01-02")
 }
 
 // GetOrder fetches an order from Dapr state store
@@ -115,6 +294,8 @@ func (s *OrderService) GetOrder(orderID string) (*spec.Order, error) {
 		return nil, err
 	}
 
+	order.ETag = data.Etag
+
 	return order, nil
 }
 
@@ -130,47 +311,136 @@ func (s *OrderService) ProcessOrder(order spec.Order) error {
 		return OrderStatusError()
 	}
 
-	if err := s.AddOrder(order); err != nil {
+	if order.Created.IsZero() {
+		order.Created = time.Now().UTC()
+	}
+
+	// Orders we've seen before are only picked up again if they never got past new, e.g. we crashed part way
+	// The saved copy is carried on with, so a payment already under way elsewhere is seen
+	existing, err := s.GetOrder(order.ID)
+	if err == nil {
+		if existing.Status != spec.OrderNew {
+			return OrderDuplicateError()
+		}
+
+		order = *existing
+	} else {
+		if ordersErr, ok := err.(OrdersError); !ok || ordersErr.Error() != NotFoundError {
+			return err
+		}
+
+		if err := s.AddOrder(order); err != nil {
+			return err
+		}
+
+		if err := s.refreshETag(&order); err != nil {
+			return err
+		}
+	}
+
+	// Suspicious orders are held for review, before any payment is taken
+	if reasons := s.screenOrder(order); len(reasons) > 0 {
+		return s.holdOrder(&order, reasons)
+	}
+
+	return s.acceptOrder(&order)
+}
+
+// acceptOrder takes payment for an order and sets it on its way
+// The order is claimed with its ETag before it is charged, so it is only ever charged once
+func (s *OrderService) acceptOrder(order *spec.Order) error {
+	if err := s.claimPayment(order); err != nil {
 		return err
 	}
 
-	err = s.SetStatus(&order, spec.OrderReceived)
-	if err != nil {
-		log.Printf("### Failed to update state for order %s\n", err)
+	// A failed payment is the end of the road for the order, but the order itself was handled fine
+	if err := s.takePayment(order); err != nil {
+		log.Printf("### Payment for order %s failed: %s\n", order.ID, err)
+		return s.SetStatus(order, spec.OrderPaymentFailed)
+	}
+
+	if err := s.SetStatus(order, spec.OrderReceived); err != nil {
+		// The order was changed while it was being paid for (e.g. cancelled) or couldn't be saved, so the money goes back
+		log.Printf("### Error! Order %s was paid for but not saved, refunding it: %s\n", order.ID, err)
+
+		if ref, refundErr := s.refund(*order, order.Amount); refundErr != nil {
+			log.Printf("### Error! Refund for order %s failed, it must be refunded by hand: %s", order.ID, refundErr)
+		} else {
+			log.Printf("### Payment for order %s refunded, ref: %s\n", order.ID, ref)
+		}
+
+		return err
 	}
 
 	log.Printf("### Order %s was saved to state store\n", order.ID)
 
+	// Fake background order processing & completion, these are persisted so they survive restarts
+	// The scheduler started by RunScheduler will pick them up when they are due
+	// Processing is as far as the order goes on its own, the warehouse then has to ship it
+	if err := s.scheduleStatus(order.ID, spec.OrderProcessing, s.processingDelay); err != nil {
+		return err
+	}
+
 	// Save order to blob storage as a text file "report"
-	// Also email to the user via SendGrid
+	// The user was emailed via SendGrid when the status was set, see SetStatus
 	// For these to work configure the components in cmd/orders/components
 	// If un-configured then nothing happens (maybe some errors are logged)
+	if err := s.SaveReport(*order); err != nil {
+		log.Printf("### Saving order report failed %s\n", err)
+	}
+
+	return nil
+}
+
+// claimPayment marks an order as being paid for, saving it with its ETag so no one else can do the same
+// A claim that is never finished (e.g. the replica crashed) runs out, after which the order can be claimed again
+func (s *OrderService) claimPayment(order *spec.Order) error {
+	if order.PaymentStarted != nil && time.Since(*order.PaymentStarted) < s.paymentTimeout+claimTimeout {
+		log.Printf("### Order %s is already being paid for", order.ID)
+		return OrderChangedError()
+	}
+
+	now := time.Now().UTC()
+	order.PaymentStarted = &now
+
+	return s.saveOrder(order)
+}
+
+// takePayment charges the order using the payment provider, storing the payment reference on the order
+func (s *OrderService) takePayment(order *spec.Order) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.paymentTimeout)
+	defer cancel()
 
-	// Currently the SendGrid integration in Dapr is fubar
-	// To be fixed by this PR https://github.com/dapr/components-contrib/pull/1867
-	err = s.EmailNotify(order)
+	ref, err := s.payments.Charge(ctx, *order)
 	if err != nil {
-		log.Printf("### Email notification failed %s\n", err)
+		return err
 	}
 
-	err = s.SaveReport(order)
+	order.PaymentRef = ref
+	log.Printf("### Payment for order %s taken, ref: %s\n", order.ID, ref)
+
+	return nil
+}
+
+// refundPayment gives back the payment for an order using the payment provider, storing the refund reference on the order
+func (s *OrderService) refundPayment(order *spec.Order) error {
+	ref, err := s.refund(*order, order.Amount)
 	if err != nil {
-		log.Printf("### Saving order report failed %s\n", err)
+		return err
 	}
 
-	// Fake background order processing, move to processing after 30 seconds
-	time.AfterFunc(30*time.Second, func() {
-		log.Printf("### Order %s is now processing\n", order.ID)
-		_ = s.SetStatus(&order, spec.OrderProcessing)
-	})
+	order.RefundRef = ref
+	log.Printf("### Payment for order %s refunded, ref: %s\n", order.ID, ref)
 
-	// Fake background order completion, move to complete after 2 minutes
-	time.AfterFunc(120*time.Second, func() {
-		log.Printf("### Order %s completed\n", order.ID)
-		_ = s.SetStatus(&order, spec.OrderComplete)
-	})
+	return s.saveOrder(order)
+}
 
-	return nil
+// refund gives back some or all of the payment for an order using the payment provider, returning the refund reference
+func (s *OrderService) refund(order spec.Order, amount float32) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.paymentTimeout)
+	defer cancel()
+
+	return s.payments.Refund(ctx, order, amount)
 }
 
 // GetOrdersForUser fetches a list of order ids for a given user
@@ -195,53 +465,200 @@ func (s *OrderService) GetOrdersForUser(userID string) ([]string, error) {
 	return orders, nil
 }
 
-// SetStatus updates the status of an order
+// GetOrderHistory fetches full orders for a given user, filtered, sorted newest first and paged
+func (s *OrderService) GetOrderHistory(userID string, query spec.OrderQuery) (*spec.OrderPage, error) {
+	orderIDs, err := s.GetOrdersForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	orders := []spec.Order{}
+
+	if len(orderIDs) == 0 {
+		return spec.QueryOrders(orders, query), nil
+	}
+
+	items, err := s.client.GetBulkState(context.Background(), s.storeName, orderIDs, nil, 10)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, item := range items {
+		// Skip anything missing or broken rather than failing the whole history
+		if item.Error != "" || item.Value == nil {
+			log.Printf("### Warning order %s for user %s could not be fetched %s", item.Key, userID, item.Error)
+			continue
+		}
+
+		order := spec.Order{}
+		if err := json.Unmarshal(item.Value, &order); err != nil {
+			log.Printf("### Warning order %s for user %s is corrupt %s", item.Key, userID, err)
+			continue
+		}
+
+		orders = append(orders, order)
+	}
+
+	return spec.QueryOrders(orders, query), nil
+}
+
+// SetStatus updates the status of an order, only changes allowed by the order state machine are accepted
 func (s *OrderService) SetStatus(order *spec.Order, status spec.OrderStatus) error {
 	log.Printf("### Setting status for order %s to %s\n", order.ID, status)
-	order.Status = status
 
-	// Save updated order list back, again keyed using user id
+	if err := order.Transition(status); err != nil {
+		log.Printf("### Error! Rejected status change for order '%s': %s", order.ID, err)
+		return err
+	}
+
+	if err := s.saveOrder(order); err != nil {
+		log.Printf("### Error! Unable to update status of order '%s': %s", order.ID, err)
+		return err
+	}
+
+	s.notifyWatchers(*order)
+	go s.dispatchWebhooks(*order)
+
+	// Stats are kept from these events, log but don't return the error as the status was changed
+	if err := s.client.PublishEvent(context.Background(), s.pubSubName, s.statusTopic, order); err != nil {
+		log.Printf("### Error! Unable to publish status change of order '%s': %s", order.ID, err)
+	}
+
+	// Statuses with an email template are emailed to the user
+	// Cancelled orders are emailed by CancelOrder instead, once any refund has been recorded
+	if s.emails.HasTemplate(order.Status) && order.Status != spec.OrderCancelled {
+		s.emailInBackground(*order)
+	}
+
+	return nil
+}
+
+// emailInBackground sends the email for the current status of an order, without holding up the caller
+func (s *OrderService) emailInBackground(order spec.Order) {
+	go func() {
+		if err := s.EmailNotify(order); err != nil {
+			log.Printf("### Email notification failed %s\n", err)
+		}
+	}()
+}
+
+// saveOrder writes an order back using the ETag it was fetched with, so changes made in the meantime aren't lost
+// On a conflict nothing is saved and OrderChangedError is returned, the caller should fetch the order and try again
+func (s *OrderService) saveOrder(order *spec.Order) error {
 	jsonPayload, err := json.Marshal(order)
 	if err != nil {
 		return err
 	}
 
-	if err := s.client.SaveState(context.Background(), s.storeName, order.ID, jsonPayload, nil); err != nil {
-		log.Printf("### Error! Unable to update status of order '%s'", order.ID)
+	err = s.client.SaveStateWithETag(context.Background(), s.storeName, order.ID, jsonPayload, order.ETag, nil,
+		dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
+	if err != nil {
+		if isConflict(err) {
+			return OrderChangedError()
+		}
+
+		return err
+	}
+
+	// The store doesn't hand back the new ETag, so read it, letting the order be saved again
+	return s.refreshETag(order)
+}
+
+// refreshETag reads the current ETag of an order that has just been saved
+func (s *OrderService) refreshETag(order *spec.Order) error {
+	data, err := s.client.GetState(context.Background(), s.storeName, order.ID, nil)
+	if err != nil {
 		return err
 	}
 
+	order.ETag = data.Etag
+
 	return nil
 }
 
-// EmailNotify uses Dapr SendGrid output binding to send an email
-// See: https://docs.dapr.io/reference/components-reference/supported-bindings/sendgrid/
-func (s *OrderService) EmailNotify(order spec.Order) error {
-	// Call the PRIVATE endpoint of the user service to get the user's email address
-	// This is not protected so no auth token is required
-	resp, err := s.client.InvokeMethod(context.Background(), "users", "private/get/"+order.ForUserID, "GET")
+// CancelOrder cancels an order that has not yet shipped, and lets other services know via pub/sub
+// Orders that were paid for are refunded, once they are safely cancelled
+func (s *OrderService) CancelOrder(orderID string) (*spec.Order, error) {
+	order, err := s.GetOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.SetStatus(order, spec.OrderCancelled); err != nil {
+		return nil, err
+	}
+
+	if order.PaymentRef != "" {
+		if err := s.refundPayment(order); err != nil {
+			// The order stays cancelled, it has a payment but no refund ref so can be found & refunded by hand
+			log.Printf("### Error! Refund for cancelled order %s failed, it must be refunded by hand: %s", order.ID, err)
+		}
+	}
+
+	s.emailInBackground(*order)
+
+	// Pending status changes are now pointless, the scheduler would reject them anyway
+	if err := s.unscheduleStatus(order.ID); err != nil {
+		log.Printf("### Warning failed to remove scheduled status changes for order %s: %s", order.ID, err)
+	}
+
+	// Publish the cancelled order, so the cart, reporting etc. can react
+	if err := s.client.PublishEvent(context.Background(), s.pubSubName, s.cancelledTopic, order); err != nil {
+		// Log but don't return the error, as the order was cancelled
+		log.Printf("### Warning failed to publish cancellation of order %s: %s", order.ID, err)
+	}
+
+	log.Printf("### Order %s was cancelled", order.ID)
+
+	return order, nil
+}
+
+// getUser fetches a user's details, such as their email address
+func (s *OrderService) getUser(userID string) (*userspec.User, error) {
+	// Call the PRIVATE endpoint of the user service, this is not protected so no auth token is required
+	resp, err := s.client.InvokeMethod(context.Background(), "users", "private/get/"+userID, "GET")
 	if err != nil {
-		return fmt.Errorf("error calling user service: %s", err)
+		return nil, fmt.Errorf("error calling user service: %s", err)
 	}
 
 	user := &userspec.User{}
+	if err := json.Unmarshal(resp, user); err != nil {
+		return nil, err
+	}
 
-	err = json.Unmarshal(resp, user)
+	return user, nil
+}
+
+// EmailNotify uses Dapr SendGrid output binding to send an email, the content depends on the order status
+// See: https://docs.dapr.io/reference/components-reference/supported-bindings/sendgrid/
+func (s *OrderService) EmailNotify(order spec.Order) error {
+	user, err := s.getUser(order.ForUserID)
+	if err != nil {
+		return err
+	}
+
+	email, err := s.emails.Render(order, *user)
 	if err != nil {
 		return err
 	}
 
 	emailMetadata := map[string]string{
 		"emailTo": user.Email,
-		"subject": "Dapr Store, order details: " + order.Title,
+		"subject": email.Subject,
 	}
 
-	emailData := "<h1>Thanks for your order!</h1>Order title: " + order.Title + "<br>Order ID: " + order.ID +
-		"<br>User: " + order.ForUserID + "<br>Amount: £" + fmt.Sprintf("%.2f", order.Amount) + "<br><br>Enjoy your new dapper threads!"
-
 	request := &dapr.InvokeBindingRequest{}
 	request.Metadata = emailMetadata
-	request.Data = []byte(emailData)
+	request.Data = []byte(email.HTML)
+
+	// The SendGrid binding only takes HTML, but other bindings can be sent both text & HTML
+	if s.emailMultipart {
+		request.Data, request.Metadata["contentType"], err = email.Multipart()
+		if err != nil {
+			return err
+		}
+	}
+
 	request.Name = s.emailOutputName
 	request.Operation = "create"
 
@@ -256,19 +673,24 @@ func (s *OrderService) EmailNotify(order spec.Order) error {
 }
 
 // SaveReport uses Dapr Azure Blob output binding to store a order report
+// The report format is set by REPORT_FORMAT, which also decides the blob name & content type
 // See: https://docs.dapr.io/reference/components-reference/supported-bindings/blobstorage/
 func (s *OrderService) SaveReport(order spec.Order) error {
-	blobName := "order_" + order.ID + ".txt"
+	blobData, err := s.reports.Render(order)
+	if err != nil {
+		log.Printf("### Problem rendering report for order %s: %s", order.ID, err.Error())
+		return err
+	}
+
+	blobName := "order_" + order.ID + "." + s.reports.Extension()
 	blobMetadata := map[string]string{
-		"ContentType": "text/plain",
+		"ContentType": s.reports.ContentType(),
 		"blobName":    blobName,
 	}
-	blobData := "----------\nTitle: " + order.Title + "\nOrder ID: " + order.ID +
-		"\nUser: " + order.ForUserID + "\nAmount: " + fmt.Sprintf("%f", order.Amount) + "\n----------"
 
 	request := &dapr.InvokeBindingRequest{}
 	request.Metadata = blobMetadata
-	request.Data = []byte(blobData)
+	request.Data = blobData
 	request.Name = s.reportOutputName
 	request.Operation = "create"
 
@@ -282,25 +704,122 @@ func (s *OrderService) SaveReport(order spec.Order) error {
 	return nil
 }
 
-// pubSubOrderReceiver is an adaptor of sorts, not part of the OrderService spec
+// DeliveryStatus tells Dapr what to do with a pub/sub message once it has been received
+// See: https://docs.dapr.io/reference/api/pubsub_api/#expected-http-response
+type DeliveryStatus string
+
+const (
+	DeliverySuccess DeliveryStatus = "SUCCESS" // Message was processed, or can safely be ignored
+	DeliveryRetry   DeliveryStatus = "RETRY"   // Message should be redelivered later
+	DeliveryDrop    DeliveryStatus = "DROP"    // Message can never be processed, a poison message
+)
+
+// How long processed event IDs are remembered for, redeliveries after this will fall back on the order ID check
+const processedEventTTL = "604800"
+
+// PubSubOrderReceiver is an adaptor of sorts, not part of the OrderService spec
 // It is registered as the receiver for new messages on the Dapr pub/sub order topic
-func (s *OrderService) PubSubOrderReceiver(event *pubsub.CloudEvent) error {
+// Redelivered events and orders already processed are acknowledged without doing anything
+func (s *OrderService) PubSubOrderReceiver(event *pubsub.CloudEvent) DeliveryStatus {
+	if s.eventProcessed(event.ID) {
+		log.Printf("### Event %s was already processed, ignoring redelivery", event.ID)
+		return DeliverySuccess
+	}
+
 	// This JSON nonsense is an "easy" way to convert
 	// The event.Data which is a map back into a real Order
 	jsonData, err := json.Marshal(event.Data)
 	if err != nil {
-		return err
+		return s.dropEvent(event.ID, spec.Order{}, "unusable event data: "+err.Error())
 	}
 
 	var order spec.Order
 	if err := json.Unmarshal(jsonData, &order); err != nil {
-		return err
+		return s.dropEvent(event.ID, spec.Order{}, "event does not contain an order: "+err.Error())
 	}
 
 	// Now we have a real order, we can process it
 	if err := s.ProcessOrder(order); err != nil {
-		return err
+		if ordersErr, ok := err.(OrdersError); ok && ordersErr.Error() == DuplicateError {
+			log.Printf("### Order %s was already processed, ignoring event %s", order.ID, event.ID)
+			s.markEventProcessed(event.ID)
+
+			return DeliverySuccess
+		}
+
+		if errors.Is(err, spec.ErrValidation) {
+			return s.dropEvent(event.ID, order, err.Error())
+		}
+
+		if ordersErr, ok := err.(OrdersError); ok && ordersErr.Error() == StatusError {
+			return s.dropEvent(event.ID, order, err.Error())
+		}
+
+		log.Printf("### Order %s in event %s failed and will be retried: %s", order.ID, event.ID, err)
+
+		return DeliveryRetry
 	}
 
-	return nil
+	s.markEventProcessed(event.ID)
+
+	return DeliverySuccess
+}
+
+// dropEvent dead-letters an event that can never be processed
+// If that fails the event is retried instead, as dropping it would lose the order
+func (s *OrderService) dropEvent(eventID string, order spec.Order, reason string) DeliveryStatus {
+	log.Printf("### Error! Event %s can not be processed, dropping it: %s", eventID, reason)
+
+	if err := s.deadLetter(eventID, order, reason); err != nil {
+		log.Printf("### Error! Unable to dead-letter event %s, it will be retried: %s", eventID, err)
+		return DeliveryRetry
+	}
+
+	return DeliveryDrop
+}
+
+// eventProcessed checks the state store for a record of an event, errors are treated as not processed
+func (s *OrderService) eventProcessed(eventID string) bool {
+	if eventID == "" {
+		return false
+	}
+
+	data, err := s.client.GetState(context.Background(), s.storeName, eventKey(eventID), nil)
+
+	return err == nil && data.Value != nil
+}
+
+// markEventProcessed records an event in the state store, so redeliveries of it can be ignored
+// First write wins, so the time recorded is always when the event was first processed
+func (s *OrderService) markEventProcessed(eventID string) {
+	if eventID == "" {
+		return
+	}
+
+	metadata := map[string]string{"ttlInSeconds": processedEventTTL}
+	processed := []byte(time.Now().UTC().Format(time.RFC3339))
+
+	err := s.client.SaveState(context.Background(), s.storeName, eventKey(eventID), processed, metadata,
+		dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
+	if err != nil && !isConflict(err) {
+		log.Printf("### Warning failed to record event %s as processed: %s", eventID, err)
+	}
+}
+
+// Events are keyed with a prefix, so they can't clash with orders or users in the state store
+func eventKey(eventID string) string {
+	return "event-" + eventID
+}
+
+// splitList splits a comma separated config value, trimming spaces and dropping empty items
+func splitList(list string) []string {
+	items := []string{}
+
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
 }
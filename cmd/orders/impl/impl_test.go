@@ -0,0 +1,822 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2020
+// Licensed under the MIT License.
+//
+// Tests of the Dapr based OrderService, against an in memory fake of Dapr
+// ----------------------------------------------------------------------------
+
+package impl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benc-uk/dapr-store/cmd/orders/spec"
+	productspec "github.com/benc-uk/dapr-store/cmd/products/spec"
+	"github.com/benc-uk/go-rest-api/pkg/dapr/pubsub"
+
+	dapr "github.com/dapr/go-sdk/client"
+)
+
+// fakeDapr is an in memory state store & pub/sub, anything else it's asked to do fails
+// Embedding the client interface means unused methods panic, rather than having to fake them all
+type fakeDapr struct {
+	dapr.Client
+
+	lock      sync.Mutex
+	state     map[string][]byte
+	etags     map[string]int
+	published map[string][]interface{} // Events published, keyed on topic
+	failSaves error                    // When set every save fails with this, like the store being down
+}
+
+func newFakeDapr() *fakeDapr {
+	return &fakeDapr{state: map[string][]byte{}, etags: map[string]int{}, published: map[string][]interface{}{}}
+}
+
+func newTestService(client dapr.Client) *OrderService {
+	return &OrderService{
+		storeName:       "statestore",
+		pubSubName:      "pubsub",
+		cancelledTopic:  "orders-cancelled",
+		statusTopic:     "orders-status",
+		ordersTopic:     "orders-queue",
+		deadLetterTopic: "orders-deadletter",
+		serviceName:     "orders",
+		client:          client,
+		emails:          NewEmailRenderer("", "£"),
+		currency:        "£",
+		taxRate:         20,
+		reports:         NewReportRenderer(ReportJSON),
+		payments:        NewFakePaymentProvider(PaymentApprove),
+		paymentTimeout:  time.Second,
+		processingDelay: time.Hour,
+		deliveryDelay:   time.Hour,
+		completeDelay:   time.Hour,
+		watchers:        map[string][]chan spec.Order{},
+		pollers:         map[string]chan struct{}{},
+		watchPoll:       10 * time.Millisecond,
+	}
+}
+
+func (f *fakeDapr) GetState(ctx context.Context, storeName, key string, meta map[string]string) (*dapr.StateItem, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	item := &dapr.StateItem{Key: key, Value: f.state[key]}
+	if item.Value != nil {
+		item.Etag = strconv.Itoa(f.etags[key])
+	}
+
+	return item, nil
+}
+
+func (f *fakeDapr) GetBulkState(ctx context.Context, storeName string, keys []string, meta map[string]string,
+	parallelism int32) ([]*dapr.BulkStateItem, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	items := []*dapr.BulkStateItem{}
+	for _, key := range keys {
+		items = append(items, &dapr.BulkStateItem{Key: key, Value: f.state[key]})
+	}
+
+	return items, nil
+}
+
+func (f *fakeDapr) SaveState(ctx context.Context, storeName, key string, data []byte, meta map[string]string, so ...dapr.StateOption) error {
+	return f.SaveStateWithETag(ctx, storeName, key, data, "", meta, so...)
+}
+
+func (f *fakeDapr) SaveStateWithETag(ctx context.Context, storeName, key string, data []byte, etag string,
+	meta map[string]string, so ...dapr.StateOption) error {
+	options := &dapr.StateOptions{}
+	for _, o := range so {
+		o(options)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.save(key, data, etag, options)
+}
+
+func (f *fakeDapr) ExecuteStateTransaction(ctx context.Context, storeName string, meta map[string]string, ops []*dapr.StateOperation) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.failSaves != nil {
+		return f.failSaves
+	}
+
+	// Check every ETag before saving anything, so the transaction is all or nothing
+	for _, op := range ops {
+		etag := ""
+		if op.Item.Etag != nil {
+			etag = op.Item.Etag.Value
+		}
+
+		if err := f.check(op.Item.Key, etag, op.Item.Options); err != nil {
+			return err
+		}
+	}
+
+	for _, op := range ops {
+		f.state[op.Item.Key] = op.Item.Value
+		f.etags[op.Item.Key]++
+	}
+
+	return nil
+}
+
+func (f *fakeDapr) DeleteState(ctx context.Context, storeName, key string, meta map[string]string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.state, key)
+
+	return nil
+}
+
+func (f *fakeDapr) PublishEvent(ctx context.Context, pubsubName, topicName string, data interface{}, opts ...dapr.PublishEventOption) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.published[topicName] = append(f.published[topicName], data)
+
+	return nil
+}
+
+func (f *fakeDapr) InvokeMethod(ctx context.Context, appID, methodName, verb string) ([]byte, error) {
+	return nil, errors.New("no services to invoke in the fake")
+}
+
+func (f *fakeDapr) InvokeOutputBinding(ctx context.Context, in *dapr.InvokeBindingRequest) error {
+	return errors.New("no bindings in the fake")
+}
+
+// save writes a value, first write wins when there's an ETag or the key must not exist yet if there isn't
+func (f *fakeDapr) save(key string, data []byte, etag string, options *dapr.StateOptions) error {
+	if f.failSaves != nil {
+		return f.failSaves
+	}
+
+	if err := f.check(key, etag, options); err != nil {
+		return err
+	}
+
+	f.state[key] = data
+	f.etags[key]++
+
+	return nil
+}
+
+func (f *fakeDapr) check(key string, etag string, options *dapr.StateOptions) error {
+	if options == nil || options.Concurrency != dapr.StateConcurrencyFirstWrite {
+		return nil
+	}
+
+	_, exists := f.state[key]
+	if (etag == "" && exists) || (etag != "" && etag != strconv.Itoa(f.etags[key])) {
+		return errors.New("possible etag mismatch. error from state store")
+	}
+
+	return nil
+}
+
+// put stores a value as JSON, for setting up tests
+func (f *fakeDapr) put(t *testing.T, key string, value interface{}) {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.state[key] = payload
+	f.etags[key]++
+}
+
+// get reads a JSON value, for checking results
+func (f *fakeDapr) get(t *testing.T, key string, value interface{}) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := json.Unmarshal(f.state[key], value); err != nil {
+		t.Fatalf("reading %s: %s", key, err)
+	}
+}
+
+func TestBackfillDayIndex(t *testing.T) {
+	fake := newFakeDapr()
+	svc := newTestService(fake)
+
+	day1, day2 := time.Date(2022, 6, 1, 10, 0, 0, 0, time.UTC), time.Date(2022, 6, 2, 10, 0, 0, 0, time.UTC)
+	lines := []spec.LineItem{{Count: 1}}
+
+	// Orders from before the daily index, only one of which has been indexed
+	fake.put(t, "old@example.net", []string{"ord-old1", "ord-old2"})
+	fake.put(t, "ord-old1", spec.Order{ID: "ord-old1", ForUserID: "old@example.net", Status: spec.OrderComplete, Created: day1, LineItems: lines})
+	fake.put(t, "ord-old2", spec.Order{ID: "ord-old2", ForUserID: "old@example.net", Status: spec.OrderComplete, Created: day2, LineItems: lines})
+	fake.put(t, dayIndexKey(day1), []string{"ord-old1"})
+
+	query := spec.OrderQuery{From: day1.Truncate(24 * time.Hour), To: day2.Add(24 * time.Hour)}
+
+	count, err := svc.ExportOrders(&strings.Builder{}, query, ExportNDJSON)
+	if err != nil || count != 1 {
+		t.Fatalf("export before backfill got %d orders: %+v", count, err)
+	}
+
+	added, err := svc.BackfillDayIndex([]string{"old@example.net", "nobody@example.net"})
+	if err != nil || added != 1 {
+		t.Errorf("backfill added %d orders, wanted 1: %+v", added, err)
+	}
+
+	out := &strings.Builder{}
+
+	count, err = svc.ExportOrders(out, query, ExportNDJSON)
+	if err != nil || count != 2 || !strings.Contains(out.String(), "ord-old2") {
+		t.Errorf("export after backfill got %d orders: %+v\n%s", count, err, out)
+	}
+
+	// Running again changes nothing
+	if added, err := svc.BackfillDayIndex([]string{"old@example.net"}); err != nil || added != 0 {
+		t.Errorf("second backfill added %d orders, wanted 0: %+v", added, err)
+	}
+}
+
+// fail makes every save fail with err, or work again when it's nil
+func (f *fakeDapr) fail(err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.failSaves = err
+}
+
+// exists checks if there's anything saved under a key
+func (f *fakeDapr) exists(key string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	_, exists := f.state[key]
+
+	return exists
+}
+
+func newOrderEvent(eventID string, order spec.Order) *pubsub.CloudEvent {
+	// Events arrive with the data as a generic map, not an Order
+	payload, _ := json.Marshal(order)
+	data := map[string]interface{}{}
+	_ = json.Unmarshal(payload, &data)
+
+	return &pubsub.CloudEvent{ID: eventID, Data: data}
+}
+
+func TestPubSubOrderReceiver(t *testing.T) {
+	fake := newFakeDapr()
+	svc := newTestService(fake)
+
+	order := spec.Order{
+		ID:        "ord-evt",
+		Title:     "Event order",
+		Amount:    11.2,
+		ForUserID: "events@example.net",
+		Status:    spec.OrderNew,
+		LineItems: []spec.LineItem{{Count: 1}},
+	}
+
+	t.Run("new event is processed", func(t *testing.T) {
+		if status := svc.PubSubOrderReceiver(newOrderEvent("evt-1", order)); status != DeliverySuccess {
+			t.Fatalf("got %s, wanted %s", status, DeliverySuccess)
+		}
+
+		saved := spec.Order{}
+		fake.get(t, order.ID, &saved)
+
+		if saved.Status != spec.OrderReceived || !svc.eventProcessed("evt-1") || !fake.exists("event-evt-1") {
+			t.Errorf("order not processed or event not recorded: %+v", saved)
+		}
+	})
+
+	t.Run("redelivered event is ignored", func(t *testing.T) {
+		before, _ := svc.GetOrder(order.ID)
+
+		if status := svc.PubSubOrderReceiver(newOrderEvent("evt-1", order)); status != DeliverySuccess {
+			t.Fatalf("got %s, wanted %s", status, DeliverySuccess)
+		}
+
+		after, _ := svc.GetOrder(order.ID)
+		if after.ETag != before.ETag || len(after.History) != len(before.History) {
+			t.Errorf("redelivered event changed the order: %+v", after)
+		}
+	})
+
+	t.Run("same order in a new event is ignored", func(t *testing.T) {
+		if status := svc.PubSubOrderReceiver(newOrderEvent("evt-2", order)); status != DeliverySuccess {
+			t.Fatalf("got %s, wanted %s", status, DeliverySuccess)
+		}
+
+		if !svc.eventProcessed("evt-2") {
+			t.Errorf("event for an already processed order was not recorded")
+		}
+	})
+
+	t.Run("event is only recorded once", func(t *testing.T) {
+		before, _ := fake.GetState(context.Background(), "statestore", "event-evt-1", nil)
+
+		svc.markEventProcessed("evt-1")
+
+		after, _ := fake.GetState(context.Background(), "statestore", "event-evt-1", nil)
+		if after.Etag != before.Etag || string(after.Value) != string(before.Value) {
+			t.Errorf("event record was overwritten")
+		}
+	})
+
+	t.Run("invalid order is dropped", func(t *testing.T) {
+		invalid := order
+		invalid.ID = "ord-invalid"
+		invalid.Amount = 0
+
+		if status := svc.PubSubOrderReceiver(newOrderEvent("evt-3", invalid)); status != DeliveryDrop {
+			t.Fatalf("got %s, wanted %s", status, DeliveryDrop)
+		}
+
+		if letters, _ := svc.GetDeadLetters(); len(letters) != 1 || letters[0].ID != "evt-3" || fake.exists(invalid.ID) {
+			t.Errorf("invalid order was not dead-lettered: %+v", letters)
+		}
+	})
+
+	t.Run("store failure is retried", func(t *testing.T) {
+		retried := order
+		retried.ID = "ord-retried"
+
+		fake.fail(errors.New("state store is down"))
+		status := svc.PubSubOrderReceiver(newOrderEvent("evt-4", retried))
+		fake.fail(nil)
+
+		if status != DeliveryRetry || svc.eventProcessed("evt-4") {
+			t.Fatalf("got %s, wanted %s and the event not recorded", status, DeliveryRetry)
+		}
+
+		if status := svc.PubSubOrderReceiver(newOrderEvent("evt-4", retried)); status != DeliverySuccess {
+			t.Errorf("retry got %s, wanted %s", status, DeliverySuccess)
+		}
+	})
+}
+
+func TestCreateReturn(t *testing.T) {
+	fake := newFakeDapr()
+	svc := newTestService(fake)
+
+	fake.put(t, "ord-ret", spec.Order{
+		ID:        "ord-ret",
+		ForUserID: "ret@example.net",
+		Status:    spec.OrderComplete,
+		LineItems: []spec.LineItem{{Count: 2, Product: productspec.Product{ID: "prd1", Cost: 5}}},
+	})
+
+	first, err := svc.CreateReturn("ord-ret", []spec.ReturnItem{{ProductID: "prd1", Count: 1}}, "too big")
+	if err != nil || first.ID != "ord-ret-R1" {
+		t.Fatalf("first return got %+v: %+v", first, err)
+	}
+
+	// Both want the last item, only one can have it and they must not share an ID
+	results := make(chan error, 2)
+	ids := make(chan string, 2)
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			ret, err := svc.CreateReturn("ord-ret", []spec.ReturnItem{{ProductID: "prd1", Count: 1}}, "too small")
+			if err == nil {
+				ids <- ret.ID
+			}
+
+			results <- err
+		}()
+	}
+
+	invalid := 0
+
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			if !strings.HasPrefix(err.Error(), ReturnInvalidPrefix) {
+				t.Errorf("concurrent return failed with %+v", err)
+			}
+
+			invalid++
+		}
+	}
+
+	if invalid != 1 {
+		t.Errorf("wanted one concurrent return rejected, got %d", invalid)
+	}
+
+	if id := <-ids; id != "ord-ret-R2" {
+		t.Errorf("concurrent return got ID %s", id)
+	}
+
+	returns, err := svc.GetReturns("ord-ret")
+	if err != nil || len(returns) != 2 || returns[0].ID == returns[1].ID {
+		t.Errorf("returns after concurrent requests %+v: %+v", returns, err)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	fake := newFakeDapr()
+	svc := newTestService(fake)
+	order := spec.Order{ID: "ord-dead", ForUserID: "dead@example.net"}
+
+	// Dead letters from different events must all be kept, however they land
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			if err := svc.deadLetter("evt-"+strconv.Itoa(i), order, "broken"); err != nil {
+				t.Errorf("dead letter %d failed: %+v", i, err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	letters, err := svc.GetDeadLetters()
+	if err != nil || len(letters) != 5 {
+		t.Fatalf("wanted 5 dead letters, got %d: %+v", len(letters), err)
+	}
+
+	if _, err := svc.ReplayDeadLetter("evt-3", nil); err != nil {
+		t.Fatalf("replay failed: %+v", err)
+	}
+
+	// A letter can only be replayed once
+	if _, err := svc.ReplayDeadLetter("evt-3", nil); err == nil || err.Error() != DeadLetterMissingError {
+		t.Errorf("second replay got %+v", err)
+	}
+
+	letters, _ = svc.GetDeadLetters()
+	if len(letters) != 4 || len(fake.published[svc.ordersTopic]) != 1 {
+		t.Errorf("after replay got %d dead letters and %d replayed", len(letters), len(fake.published[svc.ordersTopic]))
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	fake := newFakeDapr()
+	svc := newTestService(fake)
+
+	// Webhooks added and deliveries logged at the same time must all be kept
+	wg := sync.WaitGroup{}
+	hooks := make(chan string, 5)
+
+	for i := 0; i < 5; i++ {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			hook, err := svc.AddWebhook(spec.Webhook{URL: "http://example.net/hook"})
+			if err != nil {
+				t.Errorf("add webhook failed: %+v", err)
+				return
+			}
+
+			hooks <- hook.ID
+		}()
+
+		go func(i int) {
+			defer wg.Done()
+
+			svc.logDelivery(spec.WebhookDelivery{WebhookID: "hook-1", OrderID: "ord-" + strconv.Itoa(i), Attempt: 1})
+		}(i)
+	}
+
+	wg.Wait()
+	close(hooks)
+
+	if list, err := svc.GetWebhooks(); err != nil || len(list) != 5 {
+		t.Fatalf("wanted 5 webhooks, got %d: %+v", len(list), err)
+	}
+
+	if deliveries, err := svc.loadDeliveries("hook-1"); err != nil || len(deliveries) != 5 {
+		t.Errorf("wanted 5 deliveries logged, got %d: %+v", len(deliveries), err)
+	}
+
+	id := <-hooks
+	if err := svc.DeleteWebhook(id); err != nil {
+		t.Fatalf("delete webhook failed: %+v", err)
+	}
+
+	if err := svc.DeleteWebhook(id); err == nil || err.Error() != WebhookMissingError {
+		t.Errorf("second delete got %+v", err)
+	}
+
+	if list, _ := svc.GetWebhooks(); len(list) != 4 {
+		t.Errorf("wanted 4 webhooks after delete, got %d", len(list))
+	}
+}
+
+func TestPubSubStatusReceiver(t *testing.T) {
+	fake := newFakeDapr()
+	svc := newTestService(fake)
+	day := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	fake.put(t, "ord-stats", spec.Order{
+		ID:         "ord-stats",
+		ForUserID:  "stats@example.net",
+		Status:     spec.OrderNew,
+		Amount:     10,
+		PaymentRef: "pay-1",
+		Created:    day,
+		LineItems:  []spec.LineItem{{Count: 1, Product: productspec.Product{ID: "prd1", Cost: 10}}},
+	})
+
+	order, err := svc.GetOrder("ord-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing status only publishes the change, stats are kept from the event
+	if err := svc.SetStatus(order, spec.OrderReceived); err != nil {
+		t.Fatal(err)
+	}
+
+	if fake.exists(statsKey("2023-01-01")) || len(fake.published[svc.statusTopic]) != 1 {
+		t.Fatalf("wanted one status change published and no stats, got %d", len(fake.published[svc.statusTopic]))
+	}
+
+	event := &pubsub.CloudEvent{ID: "evt-status-1", Data: fake.published[svc.statusTopic][0]}
+
+	for _, want := range []DeliveryStatus{DeliverySuccess, DeliverySuccess} {
+		if got := svc.PubSubStatusReceiver(event); got != want {
+			t.Errorf("status event got %s, wanted %s", got, want)
+		}
+	}
+
+	summary, err := svc.GetStats(day, day)
+	if err != nil || summary.Orders != 1 || summary.Revenue != 10 {
+		t.Errorf("redelivered event must be counted once, got %+v: %+v", summary, err)
+	}
+
+	if got := svc.PubSubStatusReceiver(&pubsub.CloudEvent{ID: "evt-status-2", Data: "nonsense"}); got != DeliveryDrop {
+		t.Errorf("event without an order got %s", got)
+	}
+
+	fake.fail(errors.New("store down"))
+
+	if got := svc.PubSubStatusReceiver(&pubsub.CloudEvent{ID: "evt-status-3", Data: fake.published[svc.statusTopic][0]}); got != DeliveryRetry {
+		t.Errorf("event with store down got %s", got)
+	}
+}
+
+func TestWatchOrder(t *testing.T) {
+	fake := newFakeDapr()
+	svc := newTestService(fake)
+	order := spec.Order{ID: "ord-watch", ForUserID: "watch@example.net", Status: spec.OrderReceived}
+
+	fake.put(t, "ord-watch", order)
+
+	updates, stop := svc.WatchOrder("ord-watch")
+
+	// Another replica moves the order on, this instance only finds out by polling
+	if err := order.Transition(spec.OrderProcessing); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.put(t, "ord-watch", order)
+
+	timeout := time.After(time.Second)
+
+	for found := false; !found; {
+		select {
+		case update := <-updates:
+			found = update.Status == spec.OrderProcessing
+		case <-timeout:
+			t.Fatal("change made elsewhere was not seen")
+		}
+	}
+
+	stop()
+
+	// Drains anything left, and only ends once the channel is closed
+	left := 0
+	for range updates {
+		left++
+	}
+
+	t.Logf("%d updates were left after stopping", left)
+
+	svc.watchLock.Lock()
+	defer svc.watchLock.Unlock()
+
+	if len(svc.pollers) != 0 {
+		t.Errorf("order still being polled after the last watcher stopped")
+	}
+}
+
+func TestResolveReturn(t *testing.T) {
+	fake := newFakeDapr()
+	svc := newTestService(fake)
+
+	fake.put(t, "ord-res", spec.Order{
+		ID:         "ord-res",
+		ForUserID:  "res@example.net",
+		Status:     spec.OrderComplete,
+		PaymentRef: "pay-1",
+		LineItems:  []spec.LineItem{{Count: 2, Product: productspec.Product{ID: "prd1", Cost: 5}}},
+	})
+
+	items := []spec.ReturnItem{{ProductID: "prd1", Count: 1}}
+
+	first, err := svc.CreateReturn("ord-res", items, "too big")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := svc.CreateReturn("ord-res", items, "too small")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A refund that fails leaves the return to be approved again
+	svc.payments = NewFakePaymentProvider(PaymentTimeout)
+	svc.paymentTimeout = 10 * time.Millisecond
+
+	if _, err := svc.ResolveReturn(first.ID, true); err == nil || !strings.HasPrefix(err.Error(), RefundErrorPrefix) {
+		t.Fatalf("approve with failing refund got %+v", err)
+	}
+
+	if ret, _ := svc.getReturn(first.ID); ret.Status != spec.ReturnRequested {
+		t.Fatalf("return not put back after failed refund: %+v", ret)
+	}
+
+	svc.payments = NewFakePaymentProvider(PaymentApprove)
+
+	// The same return approved twice at once is only refunded once, and both returns can be approved together
+	results := make(chan error, 3)
+
+	for _, id := range []string{first.ID, first.ID, second.ID} {
+		go func(id string) {
+			_, err := svc.ResolveReturn(id, true)
+			results <- err
+		}(id)
+	}
+
+	resolved := 0
+
+	for i := 0; i < 3; i++ {
+		if err := <-results; err == nil {
+			resolved++
+		} else if err.Error() != ReturnResolvedError {
+			t.Errorf("concurrent approval failed with %+v", err)
+		}
+	}
+
+	if resolved != 2 {
+		t.Errorf("wanted 2 returns resolved, got %d", resolved)
+	}
+
+	returns, _ := svc.GetReturns("ord-res")
+	for _, r := range returns {
+		if r.Status != spec.ReturnApproved || r.RefundRef != "fake-refund-ord-res-5.00" {
+			t.Errorf("return %s not approved and refunded: %+v", r.ID, r)
+		}
+	}
+
+	if order, err := svc.GetOrder("ord-res"); err != nil || order.Status != spec.OrderReturned {
+		t.Errorf("order not returned after approving both returns: %+v %+v", order, err)
+	}
+}
+
+// hookedPayments approves everything, running whileCharging part way through each charge
+type hookedPayments struct {
+	lock          sync.Mutex
+	charged       int
+	refunded      int
+	whileCharging func()
+}
+
+func (p *hookedPayments) Charge(ctx context.Context, order spec.Order) (string, error) {
+	if p.whileCharging != nil {
+		p.whileCharging()
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.charged++
+
+	return "hooked-" + strconv.Itoa(p.charged), nil
+}
+
+func (p *hookedPayments) Refund(ctx context.Context, order spec.Order, amount float32) (string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.refunded++
+
+	return "hooked-refund-" + strconv.Itoa(p.refunded), nil
+}
+
+func TestAcceptOrder(t *testing.T) {
+	fake := newFakeDapr()
+	svc := newTestService(fake)
+	payments := &hookedPayments{}
+	svc.payments = payments
+
+	order := spec.Order{
+		ID:        "ord-accept",
+		Title:     "Accept",
+		Amount:    10,
+		ForUserID: "accept@example.net",
+		Status:    spec.OrderNew,
+		LineItems: []spec.LineItem{{Count: 1, Product: productspec.Product{ID: "prd1", Cost: 10}}},
+	}
+
+	// The order is cancelled by someone else while it is being paid for
+	payments.whileCharging = func() {
+		if _, err := svc.CancelOrder(order.ID); err != nil {
+			t.Errorf("cancel while charging failed: %+v", err)
+		}
+	}
+
+	if err := svc.ProcessOrder(order); err == nil || err.Error() != ChangedError {
+		t.Errorf("order changed while paying got %+v", err)
+	}
+
+	if payments.charged != 1 || payments.refunded != 1 {
+		t.Errorf("wanted the charge refunded, got %d charged and %d refunded", payments.charged, payments.refunded)
+	}
+
+	if saved, err := svc.GetOrder(order.ID); err != nil || saved.Status != spec.OrderCancelled {
+		t.Errorf("order not left cancelled: %+v %+v", saved, err)
+	}
+
+	// The same order again, while the first attempt is still paying for it
+	order.ID = "ord-accept2"
+	payments.whileCharging = func() {
+		if err := svc.ProcessOrder(order); err == nil || err.Error() != ChangedError {
+			t.Errorf("order being paid for elsewhere got %+v", err)
+		}
+	}
+
+	if err := svc.ProcessOrder(order); err != nil {
+		t.Errorf("process order failed: %+v", err)
+	}
+
+	if payments.charged != 2 || payments.refunded != 1 {
+		t.Errorf("wanted one more charge, got %d charged and %d refunded", payments.charged, payments.refunded)
+	}
+}
+
+func TestReviewOrder(t *testing.T) {
+	fake := newFakeDapr()
+	svc := newTestService(fake)
+	payments := &hookedPayments{whileCharging: func() { time.Sleep(50 * time.Millisecond) }}
+	svc.payments = payments
+
+	fake.put(t, "ord-held", spec.Order{
+		ID:        "ord-held",
+		Amount:    10,
+		ForUserID: "held@example.net",
+		Status:    spec.OrderOnHold,
+		LineItems: []spec.LineItem{{Count: 1, Product: productspec.Product{ID: "prd1", Cost: 10}}},
+	})
+
+	// Released twice at once, only one release gets to charge the order
+	results := make(chan error, 2)
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := svc.ReviewOrder("ord-held", true)
+			results <- err
+		}()
+	}
+
+	released := 0
+
+	for i := 0; i < 2; i++ {
+		if err := <-results; err == nil {
+			released++
+		} else if err.Error() != ChangedError && err.Error() != NotHeldError {
+			t.Errorf("second release failed with %+v", err)
+		}
+	}
+
+	if released != 1 || payments.charged != 1 {
+		t.Errorf("wanted one release and one charge, got %d released and %d charged", released, payments.charged)
+	}
+
+	if order, err := svc.GetOrder("ord-held"); err != nil || order.Status != spec.OrderReceived || order.PaymentRef != "hooked-1" {
+		t.Errorf("released order not received and paid: %+v %+v", order, err)
+	}
+}
@@ -0,0 +1,295 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2020
+// Licensed under the MIT License.
+//
+// Invoices for orders, numbered in sequence and rendered as HTML or PDF
+// ----------------------------------------------------------------------------
+
+package impl
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"strconv"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+
+	"github.com/benc-uk/dapr-store/cmd/orders/spec"
+)
+
+// Key in the state store holding the last invoice number issued
+const invoiceSequenceKey = "invoices-sequence"
+
+const invoicePrefix = "INV-"
+
+//go:embed templates/invoice.html
+var invoiceHTML string
+
+// GetInvoice fetches the invoice for an order, issuing it with the next invoice number the first time
+func (s *OrderService) GetInvoice(orderID string) (*spec.Invoice, error) {
+	order, err := s.GetOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !order.Invoiceable() {
+		return nil, InvoiceUnavailableError()
+	}
+
+	for attempt := 1; ; attempt++ {
+		invoice, err := s.loadInvoice(orderID)
+		if err != nil || invoice != nil {
+			return invoice, err
+		}
+
+		// A conflict means another invoice was issued at the same time, which might have been for this order
+		invoice, err = s.issueInvoice(*order)
+		if err == nil || !isConflict(err) {
+			return invoice, err
+		}
+
+		if attempt >= maxSaveAttempts {
+			log.Printf("### Error!, gave up issuing invoice for order %s after %d attempts", orderID, attempt)
+			return nil, err
+		}
+
+		time.Sleep(time.Duration(attempt) * 50 * time.Millisecond)
+	}
+}
+
+// issueInvoice makes a single attempt at creating an invoice, and taking the next number in the sequence
+// Both are written in a single transaction, with ETags so numbers are never skipped or used twice
+func (s *OrderService) issueInvoice(order spec.Order) (*spec.Invoice, error) {
+	data, err := s.client.GetState(context.Background(), s.storeName, invoiceSequenceKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	last := 0
+	if data.Value != nil {
+		if last, err = strconv.Atoi(string(data.Value)); err != nil {
+			return nil, err
+		}
+	}
+
+	number := fmt.Sprintf("%s%06d", invoicePrefix, last+1)
+	invoice := spec.NewInvoice(number, order, s.seller, s.customer(order.ForUserID), s.taxRate, s.currency, time.Now().UTC())
+
+	invoicePayload, err := json.Marshal(invoice)
+	if err != nil {
+		return nil, err
+	}
+
+	firstWrite := &dapr.StateOptions{
+		Concurrency: dapr.StateConcurrencyFirstWrite,
+		Consistency: dapr.StateConsistencyStrong,
+	}
+
+	sequenceItem := &dapr.SetStateItem{Key: invoiceSequenceKey, Value: []byte(strconv.Itoa(last + 1)), Options: firstWrite}
+	if data.Etag != "" {
+		sequenceItem.Etag = &dapr.ETag{Value: data.Etag}
+	}
+
+	ops := []*dapr.StateOperation{
+		{Type: dapr.StateOperationTypeUpsert, Item: sequenceItem},
+		{Type: dapr.StateOperationTypeUpsert, Item: &dapr.SetStateItem{Key: invoiceKey(order.ID), Value: invoicePayload, Options: firstWrite}},
+	}
+
+	if err := s.client.ExecuteStateTransaction(context.Background(), s.storeName, nil, ops); err != nil {
+		return nil, err
+	}
+
+	log.Printf("### Invoice %s issued for order %s", number, order.ID)
+
+	return &invoice, nil
+}
+
+// customer looks up the user an order is for, only the user ID is used if that fails
+func (s *OrderService) customer(userID string) spec.Customer {
+	customer := spec.Customer{UserID: userID}
+
+	user, err := s.getUser(userID)
+	if err != nil {
+		log.Printf("### Warning unable to get user details for invoice: %s", err)
+		return customer
+	}
+
+	customer.Name = user.DisplayName
+	customer.Email = user.Email
+
+	return customer
+}
+
+func (s *OrderService) loadInvoice(orderID string) (*spec.Invoice, error) {
+	data, err := s.client.GetState(context.Background(), s.storeName, invoiceKey(orderID), nil)
+	if err != nil || data.Value == nil {
+		return nil, err
+	}
+
+	invoice := &spec.Invoice{}
+	if err := json.Unmarshal(data.Value, invoice); err != nil {
+		return nil, err
+	}
+
+	return invoice, nil
+}
+
+func invoiceKey(orderID string) string {
+	return "invoice-" + orderID
+}
+
+// Amounts on invoices are shown in the currency the invoice was issued in
+func invoiceMoney(invoice spec.Invoice) func(float32) string {
+	return func(amount float32) string {
+		return fmt.Sprintf("%s%.2f", invoice.Currency, amount)
+	}
+}
+
+func percent(rate float32) string {
+	return strconv.FormatFloat(float64(rate), 'f', -1, 32) + "%"
+}
+
+// RenderInvoiceHTML renders an invoice as a standalone HTML page, suitable for printing
+func RenderInvoiceHTML(invoice spec.Invoice) ([]byte, error) {
+	tmpl, err := htmltemplate.New("invoice").Funcs(htmltemplate.FuncMap{"money": invoiceMoney(invoice), "percent": percent}).Parse(invoiceHTML)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	err = tmpl.Execute(buf, invoice)
+
+	return buf.Bytes(), err
+}
+
+// RenderInvoicePDF renders an invoice as an A4 PDF, line items carry over onto extra pages as needed
+func RenderInvoicePDF(invoice spec.Invoice) []byte {
+	money := invoiceMoney(invoice)
+
+	const left, right = 50.0, pdfPageWidth - 50
+
+	doc := &pdfDoc{}
+	doc.newPage()
+
+	// Seller top right, invoice details top left
+	y := 790.0
+	doc.text(380, y, 11, true, invoice.Seller.Name)
+
+	sellerLines := append([]string{}, invoice.Seller.Address...)
+	if invoice.Seller.Email != "" {
+		sellerLines = append(sellerLines, invoice.Seller.Email)
+	}
+
+	if invoice.Seller.TaxID != "" {
+		sellerLines = append(sellerLines, "Tax ID: "+invoice.Seller.TaxID)
+	}
+
+	for i, line := range sellerLines {
+		doc.text(380, y-14-float64(i)*12, 9, false, line)
+	}
+
+	doc.text(left, y, 22, true, "INVOICE")
+
+	details := []string{
+		"Invoice number: " + invoice.Number,
+		"Date: " + invoice.Issued.Format("2 January 2006"),
+		"Order ID: " + invoice.OrderID,
+	}
+	if invoice.PaymentRef != "" {
+		details = append(details, "Payment ref: "+invoice.PaymentRef)
+	}
+
+	y -= 30
+	for _, line := range details {
+		doc.text(left, y, 10, false, line)
+		y -= 13
+	}
+
+	y -= 10
+	doc.text(left, y, 10, true, "Bill to")
+
+	for _, line := range []string{invoice.Customer.Name, invoice.Customer.Email, "Customer ID: " + invoice.Customer.UserID} {
+		if line != "" {
+			y -= 13
+			doc.text(left, y, 10, false, line)
+		}
+	}
+
+	// Columns are right aligned at these positions, other than the description
+	columns := []float64{330, 395, 445, 495, right}
+	tableHeader := func() {
+		y -= 30
+		doc.text(left, y, 9, true, "Description")
+
+		for i, heading := range []string{"Qty", "Unit price", "Net", "Tax", "Total"} {
+			doc.textRight(columns[i], y, 9, true, heading)
+		}
+
+		doc.line(left, y-5, right, y-5)
+	}
+
+	tableHeader()
+
+	for _, line := range invoice.Lines {
+		if y < 120 {
+			doc.newPage()
+
+			y = 810
+			doc.text(left, y, 9, false, "Invoice "+invoice.Number+" continued")
+			tableHeader()
+		}
+
+		y -= 18
+		name := []rune(line.Name)
+		if len(name) > 48 {
+			name = append(name[:45], '.', '.', '.')
+		}
+
+		doc.text(left, y, 9, false, string(name))
+
+		for i, value := range []string{strconv.Itoa(line.Count), money(line.UnitPrice), money(line.Net), money(line.Tax), money(line.Gross)} {
+			doc.textRight(columns[i], y, 9, false, value)
+		}
+
+		doc.line(left, y-5, right, y-5)
+	}
+
+	// Tax breakdown & totals need to stay together
+	if y < 120+float64(len(invoice.Taxes)+4)*14 {
+		doc.newPage()
+
+		y = 810
+	}
+
+	y -= 30
+	doc.text(left, y, 9, true, "Tax rate")
+	doc.textRight(columns[2], y, 9, true, "Net")
+	doc.textRight(columns[3], y, 9, true, "Tax")
+
+	for _, tax := range invoice.Taxes {
+		y -= 14
+		doc.text(left, y, 9, false, percent(tax.Rate))
+		doc.textRight(columns[2], y, 9, false, money(tax.Net))
+		doc.textRight(columns[3], y, 9, false, money(tax.Tax))
+	}
+
+	y -= 24
+	doc.text(columns[1], y, 10, false, "Total net")
+	doc.textRight(right, y, 10, false, money(invoice.Net))
+	y -= 14
+	doc.text(columns[1], y, 10, false, "Total tax")
+	doc.textRight(right, y, 10, false, money(invoice.Tax))
+	y -= 16
+	doc.text(columns[1], y, 11, true, "Total")
+	doc.textRight(right, y, 11, true, money(invoice.Total))
+
+	doc.text(left, 50, 8, false, "Prices include tax at the rates shown")
+
+	return doc.bytes()
+}
@@ -0,0 +1,63 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2020
+// Licensed under the MIT License.
+//
+// Fake implementation of the PaymentProvider, for testing checkout
+// ----------------------------------------------------------------------------
+
+package impl
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/benc-uk/dapr-store/cmd/orders/spec"
+)
+
+// Modes the fake payment provider can run in
+const (
+	PaymentApprove = "approve"
+	PaymentDecline = "decline"
+	PaymentTimeout = "timeout"
+)
+
+// FakePaymentProvider is a PaymentProvider that never talks to a real processor
+// Depending on its mode it approves every payment, declines them all or never responds
+type FakePaymentProvider struct {
+	mode string
+}
+
+// NewFakePaymentProvider creates a FakePaymentProvider, unknown modes fall back to approving payments
+func NewFakePaymentProvider(mode string) *FakePaymentProvider {
+	if mode != PaymentApprove && mode != PaymentDecline && mode != PaymentTimeout {
+		log.Printf("### Warning unknown fake payment mode '%s', payments will be approved", mode)
+
+		mode = PaymentApprove
+	}
+
+	return &FakePaymentProvider{mode}
+}
+
+// Charge pretends to take payment for an order
+func (p *FakePaymentProvider) Charge(ctx context.Context, order spec.Order) (string, error) {
+	switch p.mode {
+	case PaymentDecline:
+		return "", PaymentFailedError("declined")
+	case PaymentTimeout:
+		<-ctx.Done()
+		return "", PaymentFailedError(ctx.Err().Error())
+	}
+
+	return fmt.Sprintf("fake-%s-%.2f", order.ID, order.Amount), nil
+}
+
+// Refund pretends to give back some or all of the payment for an order, only the timeout mode stops it working
+func (p *FakePaymentProvider) Refund(ctx context.Context, order spec.Order, amount float32) (string, error) {
+	if p.mode == PaymentTimeout {
+		<-ctx.Done()
+		return "", RefundFailedError(ctx.Err().Error())
+	}
+
+	return fmt.Sprintf("fake-refund-%s-%.2f", order.ID, amount), nil
+}
@@ -0,0 +1,162 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2020
+// Licensed under the MIT License.
+//
+// Order reports, rendered in a choice of formats
+// ----------------------------------------------------------------------------
+
+package impl
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"time"
+
+	"github.com/benc-uk/dapr-store/cmd/orders/spec"
+)
+
+// Supported report formats
+const (
+	ReportJSON = "json"
+	ReportCSV  = "csv"
+	ReportHTML = "html"
+)
+
+// ReportRenderer turns an order into a report document
+type ReportRenderer interface {
+	Render(order spec.Order) ([]byte, error)
+	ContentType() string
+	Extension() string
+}
+
+// NewReportRenderer creates a ReportRenderer for a format, unknown formats fall back to JSON
+func NewReportRenderer(format string) ReportRenderer {
+	switch format {
+	case ReportJSON:
+		return jsonReport{}
+	case ReportCSV:
+		return csvReport{}
+	case ReportHTML:
+		return htmlReport{}
+	}
+
+	log.Printf("### Warning unknown report format '%s', reports will be JSON", format)
+
+	return jsonReport{}
+}
+
+// Report is the content of an order report, common to all formats
+type report struct {
+	OrderID   string       `json:"orderId"`
+	Title     string       `json:"title"`
+	User      string       `json:"user"`
+	Status    string       `json:"status"`
+	Created   time.Time    `json:"created"`
+	LineItems []reportLine `json:"lineItems"`
+	Total     float32      `json:"total"`
+}
+
+type reportLine struct {
+	ProductID string  `json:"productId"`
+	Name      string  `json:"name"`
+	Count     int     `json:"count"`
+	UnitPrice float32 `json:"unitPrice"`
+	LineTotal float32 `json:"lineTotal"`
+}
+
+func newReport(order spec.Order) report {
+	r := report{
+		OrderID:   order.ID,
+		Title:     order.Title,
+		User:      order.ForUserID,
+		Status:    string(order.Status),
+		Created:   order.Created,
+		LineItems: []reportLine{},
+		Total:     order.Amount,
+	}
+
+	for _, line := range order.LineItems {
+		r.LineItems = append(r.LineItems, reportLine{
+			ProductID: line.Product.ID,
+			Name:      line.Product.Name,
+			Count:     line.Count,
+			UnitPrice: line.Product.Cost,
+			LineTotal: line.Product.Cost * float32(line.Count),
+		})
+	}
+
+	return r
+}
+
+type jsonReport struct{}
+
+func (jsonReport) ContentType() string { return "application/json" }
+func (jsonReport) Extension() string   { return "json" }
+
+func (jsonReport) Render(order spec.Order) ([]byte, error) {
+	return json.MarshalIndent(newReport(order), "", "  ")
+}
+
+// CSV reports have a row per line item, followed by a row for the order total
+type csvReport struct{}
+
+func (csvReport) ContentType() string { return "text/csv" }
+func (csvReport) Extension() string   { return "csv" }
+
+func (csvReport) Render(order spec.Order) ([]byte, error) {
+	r := newReport(order)
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+
+	_ = w.Write([]string{"orderId", "title", "user", "productId", "name", "count", "unitPrice", "lineTotal"})
+
+	for _, line := range r.LineItems {
+		_ = w.Write([]string{
+			r.OrderID, r.Title, r.User, line.ProductID, line.Name,
+			fmt.Sprint(line.Count), money(line.UnitPrice), money(line.LineTotal),
+		})
+	}
+
+	_ = w.Write([]string{r.OrderID, r.Title, r.User, "", "TOTAL", "", "", money(r.Total)})
+	w.Flush()
+
+	return buf.Bytes(), w.Error()
+}
+
+type htmlReport struct{}
+
+func (htmlReport) ContentType() string { return "text/html" }
+func (htmlReport) Extension() string   { return "html" }
+
+var htmlReportTemplate = htmltemplate.Must(htmltemplate.New("report").Funcs(htmltemplate.FuncMap{"money": money}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>Order {{.OrderID}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Order ID: {{.OrderID}}<br>User: {{.User}}<br>Status: {{.Status}}<br>Created: {{.Created.Format "2006-01-02 15:04:05"}}</p>
+<table>
+<tr><th>Product ID</th><th>Name</th><th>Count</th><th>Unit price</th><th>Total</th></tr>
+{{- range .LineItems}}
+<tr><td>{{.ProductID}}</td><td>{{.Name}}</td><td>{{.Count}}</td><td>{{money .UnitPrice}}</td><td>{{money .LineTotal}}</td></tr>
+{{- end}}
+<tr><th colspan="4">Order total</th><th>{{money .Total}}</th></tr>
+</table>
+</body>
+</html>
+`))
+
+func (htmlReport) Render(order spec.Order) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := htmlReportTemplate.Execute(buf, newReport(order))
+
+	return buf.Bytes(), err
+}
+
+// Amounts in reports always have two decimal places, and no currency symbol
+func money(amount float32) string {
+	return fmt.Sprintf("%.2f", amount)
+}
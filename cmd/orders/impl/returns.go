@@ -0,0 +1,324 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2020
+// Licensed under the MIT License.
+//
+// Returns (RMA) and refunds for completed orders
+// ----------------------------------------------------------------------------
+
+package impl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/benc-uk/dapr-store/cmd/orders/spec"
+
+	dapr "github.com/dapr/go-sdk/client"
+)
+
+// CreateReturn raises a return request for items on a completed order, the refund amount is calculated up front
+func (s *OrderService) CreateReturn(orderID string, items []spec.ReturnItem, reason string) (*spec.Return, error) {
+	order, err := s.GetOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if order.Status != spec.OrderComplete && order.Status != spec.OrderPartiallyRefunded {
+		return nil, OrderStatusError()
+	}
+
+	for attempt := 1; ; attempt++ {
+		ret, err := s.addReturn(*order, items, reason)
+		if err == nil {
+			log.Printf("### Return %s for order %s was requested, refund would be %.2f", ret.ID, orderID, ret.RefundAmount)
+
+			return ret, nil
+		}
+
+		if !isConflict(err) {
+			return nil, err
+		}
+
+		if attempt >= maxSaveAttempts {
+			log.Printf("### Error!, gave up saving return for order '%s' after %d attempts", orderID, attempt)
+			return nil, err
+		}
+
+		log.Printf("### Returns for order '%s' changed while saving, retrying", orderID)
+		time.Sleep(time.Duration(attempt) * 50 * time.Millisecond)
+	}
+}
+
+// addReturn makes a single attempt at transactionally saving a new return, and the order's list of returns
+// The list is saved with its ETag, so the ID and what can be refunded are always worked out from every other return
+func (s *OrderService) addReturn(order spec.Order, items []spec.ReturnItem, reason string) (*spec.Return, error) {
+	data, err := s.client.GetState(context.Background(), s.storeName, returnsKey(order.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Index of return IDs for the order, held as an array keyed using the order ID
+	returnIDs := []string{}
+
+	if data.Value != nil {
+		if err := json.Unmarshal(data.Value, &returnIDs); err != nil {
+			return nil, err
+		}
+	}
+
+	returns, err := s.loadReturns(returnIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	refund, err := spec.Refund(order, items, spec.ReturnedCounts(returns))
+	if err != nil {
+		return nil, ReturnInvalidError(err.Error())
+	}
+
+	ret := &spec.Return{
+		ID:           fmt.Sprintf("%s-R%d", order.ID, len(returnIDs)+1),
+		OrderID:      order.ID,
+		Items:        items,
+		Reason:       reason,
+		Status:       spec.ReturnRequested,
+		RefundAmount: refund,
+		Created:      time.Now().UTC(),
+	}
+
+	retPayload, err := json.Marshal(ret)
+	if err != nil {
+		return nil, err
+	}
+
+	indexPayload, err := json.Marshal(append(returnIDs, ret.ID))
+	if err != nil {
+		return nil, err
+	}
+
+	// First write wins on both, with no ETag this means the return must not exist yet
+	options := &dapr.StateOptions{Concurrency: dapr.StateConcurrencyFirstWrite, Consistency: dapr.StateConsistencyStrong}
+	index := &dapr.SetStateItem{Key: returnsKey(order.ID), Value: indexPayload, Options: options}
+
+	if data.Etag != "" {
+		index.Etag = &dapr.ETag{Value: data.Etag}
+	}
+
+	ops := []*dapr.StateOperation{
+		{Type: dapr.StateOperationTypeUpsert, Item: &dapr.SetStateItem{Key: returnKey(ret.ID), Value: retPayload, Options: options}},
+		{Type: dapr.StateOperationTypeUpsert, Item: index},
+	}
+
+	return ret, s.client.ExecuteStateTransaction(context.Background(), s.storeName, nil, ops)
+}
+
+// GetReturns fetches all returns for an order, oldest first
+func (s *OrderService) GetReturns(orderID string) ([]spec.Return, error) {
+	data, err := s.client.GetState(context.Background(), s.storeName, returnsKey(orderID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	returnIDs := []string{}
+
+	if data.Value != nil {
+		if err := json.Unmarshal(data.Value, &returnIDs); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.loadReturns(returnIDs)
+}
+
+func (s *OrderService) loadReturns(returnIDs []string) ([]spec.Return, error) {
+	returns := []spec.Return{}
+
+	for _, id := range returnIDs {
+		ret, err := s.getReturn(id)
+		if err != nil {
+			return nil, err
+		}
+
+		returns = append(returns, *ret)
+	}
+
+	return returns, nil
+}
+
+// ResolveReturn approves or rejects a requested return
+// The decision is saved first using the ETag of the return, so it can only be made once. Approved returns are then
+// refunded and the order moved to returned or partially refunded, depending on what is left
+func (s *OrderService) ResolveReturn(returnID string, approve bool) (*spec.Return, error) {
+	ret, err := s.getReturn(returnID)
+	if err != nil {
+		return nil, err
+	}
+
+	if ret.Status != spec.ReturnRequested {
+		return nil, ReturnStatusError()
+	}
+
+	now := time.Now().UTC()
+	ret.Resolved = &now
+	ret.Status = spec.ReturnRejected
+
+	if approve {
+		ret.Status = spec.ReturnApproved
+	}
+
+	if err := s.saveReturn(ret); err != nil {
+		return nil, err
+	}
+
+	if approve {
+		if err := s.refundReturn(ret); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("### Return %s for order %s was %s", ret.ID, ret.OrderID, ret.Status)
+
+	return ret, nil
+}
+
+// refundReturn gives back the money for an approved return, then updates the status of the order
+// If the refund fails the return is put back to requested, so it can be approved again
+func (s *OrderService) refundReturn(ret *spec.Return) error {
+	order, err := s.GetOrder(ret.OrderID)
+	if err != nil {
+		return s.unresolveReturn(ret, err)
+	}
+
+	ref, err := s.refund(*order, ret.RefundAmount)
+	if err != nil {
+		return s.unresolveReturn(ret, err)
+	}
+
+	ret.RefundRef = ref
+	log.Printf("### Return %s refunded %.2f, ref: %s\n", ret.ID, ret.RefundAmount, ref)
+
+	// Log but carry on, the money has gone back so the order must still be updated
+	if err := s.saveReturn(ret); err != nil {
+		log.Printf("### Error! Return %s was refunded but the refund ref %s was not saved: %s", ret.ID, ref, err)
+	}
+
+	if err := s.setReturnedStatus(ret.OrderID); err != nil {
+		log.Printf("### Error! Return %s was refunded but order %s was not updated: %s", ret.ID, ret.OrderID, err)
+		return err
+	}
+
+	return nil
+}
+
+// unresolveReturn puts a return back to requested after it couldn't be refunded, returning the reason it failed
+func (s *OrderService) unresolveReturn(ret *spec.Return, reason error) error {
+	ret.Status = spec.ReturnRequested
+	ret.Resolved = nil
+
+	if err := s.saveReturn(ret); err != nil {
+		log.Printf("### Error! Return %s was not refunded and is stuck as approved: %s", ret.ID, err)
+	}
+
+	return reason
+}
+
+// setReturnedStatus updates the status of an order, based on all its approved returns
+// Other returns for the order can be approved at the same time, so on a conflict it is all worked out again
+func (s *OrderService) setReturnedStatus(orderID string) error {
+	for attempt := 1; ; attempt++ {
+		order, err := s.GetOrder(orderID)
+		if err != nil {
+			return err
+		}
+
+		returns, err := s.GetReturns(orderID)
+		if err != nil {
+			return err
+		}
+
+		approved := []spec.Return{}
+
+		for _, r := range returns {
+			if r.Status == spec.ReturnApproved {
+				approved = append(approved, r)
+			}
+		}
+
+		status := spec.OrderPartiallyRefunded
+		if spec.FullyReturned(*order, spec.ReturnedCounts(approved)) {
+			status = spec.OrderReturned
+		}
+
+		// Another return approved at the same time got there first
+		if order.Status == spec.OrderReturned {
+			return nil
+		}
+
+		err = s.SetStatus(order, status)
+		if err == nil || err.Error() != ChangedError || attempt >= maxSaveAttempts {
+			return err
+		}
+
+		time.Sleep(time.Duration(attempt) * 50 * time.Millisecond)
+	}
+}
+
+func (s *OrderService) getReturn(returnID string) (*spec.Return, error) {
+	data, err := s.client.GetState(context.Background(), s.storeName, returnKey(returnID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if data.Value == nil {
+		return nil, ReturnNotFoundError()
+	}
+
+	ret := &spec.Return{}
+	if err := json.Unmarshal(data.Value, ret); err != nil {
+		return nil, err
+	}
+
+	ret.ETag = data.Etag
+
+	return ret, nil
+}
+
+// saveReturn writes a return back using the ETag it was fetched with, a conflict means it was resolved by someone else
+func (s *OrderService) saveReturn(ret *spec.Return) error {
+	jsonPayload, err := json.Marshal(ret)
+	if err != nil {
+		return err
+	}
+
+	err = s.client.SaveStateWithETag(context.Background(), s.storeName, returnKey(ret.ID), jsonPayload, ret.ETag, nil,
+		dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
+	if err != nil {
+		if isConflict(err) {
+			return ReturnStatusError()
+		}
+
+		return err
+	}
+
+	// Same as orders, read the new ETag so the return can be saved again
+	data, err := s.client.GetState(context.Background(), s.storeName, returnKey(ret.ID), nil)
+	if err != nil {
+		return err
+	}
+
+	ret.ETag = data.Etag
+
+	return nil
+}
+
+// Returns are keyed with a prefix, so they can't clash with orders or users in the state store
+func returnKey(returnID string) string {
+	return "return-" + returnID
+}
+
+func returnsKey(orderID string) string {
+	return "returns-" + orderID
+}
@@ -0,0 +1,200 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2020
+// Licensed under the MIT License.
+//
+// Durable scheduling of order status transitions, persisted in Dapr state
+// ----------------------------------------------------------------------------
+
+package impl
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/benc-uk/dapr-store/cmd/orders/spec"
+)
+
+// Key in the state store holding all pending status transitions
+const scheduleKey = "orders-schedule"
+
+// How long a transition claimed by a replica is left, before another replica may take it over
+const claimTimeout = time.Minute
+
+// transition is a status change for an order that is due at some point in the future
+type transition struct {
+	OrderID string           `json:"orderId"`
+	Status  spec.OrderStatus `json:"status"`
+	Due     time.Time        `json:"due"`
+	Claimed time.Time        `json:"claimed"` // When a replica took the transition to apply it
+}
+
+// same checks if two transitions are the same scheduled change, ignoring any claim
+func (t transition) same(other transition) bool {
+	return t.OrderID == other.OrderID && t.Status == other.Status && t.Due.Equal(other.Due)
+}
+
+// scheduleStatus persists a status change for an order, to be applied after the given delay
+func (s *OrderService) scheduleStatus(orderID string, status spec.OrderStatus, delay time.Duration) error {
+	due := transition{
+		OrderID: orderID,
+		Status:  status,
+		Due:     time.Now().UTC().Add(delay),
+	}
+
+	return s.updateSchedule(func(schedule []transition) []transition {
+		return append(schedule, due)
+	})
+}
+
+// unscheduleStatus removes any pending status changes for an order
+func (s *OrderService) unscheduleStatus(orderID string) error {
+	return s.updateSchedule(func(schedule []transition) []transition {
+		pending := []transition{}
+
+		for _, t := range schedule {
+			if t.OrderID != orderID {
+				pending = append(pending, t)
+			}
+		}
+
+		if len(pending) == len(schedule) {
+			return nil
+		}
+
+		return pending
+	})
+}
+
+// RunScheduler applies due status transitions every interval, it blocks so run it as a goroutine
+// The first pass happens immediately, which resumes any transitions left over from a previous run
+func (s *OrderService) RunScheduler(interval time.Duration) {
+	log.Printf("### ⏰ Order scheduler started, checking every %s", interval)
+
+	for {
+		if err := s.applyDueTransitions(); err != nil {
+			log.Printf("### Error! Order scheduler failed: %s", err)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// applyDueTransitions sets the status of orders with transitions that are due, and removes them from the schedule
+// Due transitions are claimed before they are applied, so when there are many replicas only one applies each
+// A claim that is never finished (e.g. the replica crashed) runs out after claimTimeout, and is picked up again
+func (s *OrderService) applyDueTransitions() error {
+	var claimed []transition
+
+	err := s.updateSchedule(func(schedule []transition) []transition {
+		now := time.Now().UTC()
+		claimed = nil
+
+		for i, t := range schedule {
+			if t.Due.After(now) || now.Sub(t.Claimed) < claimTimeout {
+				continue
+			}
+
+			schedule[i].Claimed = now
+			claimed = append(claimed, schedule[i])
+		}
+
+		if len(claimed) == 0 {
+			return nil
+		}
+
+		return schedule
+	})
+	if err != nil {
+		return err
+	}
+
+	// Oldest first, so an order always moves through its statuses in sequence
+	sort.SliceStable(claimed, func(i, j int) bool {
+		return claimed[i].Due.Before(claimed[j].Due)
+	})
+
+	done := []transition{}
+	retry := []transition{}
+
+	for _, t := range claimed {
+		order, err := s.GetOrder(t.OrderID)
+		if err != nil {
+			// Keep the transition when the store is having problems, but not when the order has gone
+			if ordersErr, ok := err.(OrdersError); !ok || ordersErr.Error() != NotFoundError {
+				retry = append(retry, t)
+			} else {
+				done = append(done, t)
+			}
+
+			log.Printf("### Scheduled status change for order %s skipped: %s", t.OrderID, err)
+
+			continue
+		}
+
+		if err := s.SetStatus(order, t.Status); err != nil {
+			// An illegal status change will never succeed, so only retry other errors
+			if _, illegal := err.(spec.TransitionError); !illegal {
+				retry = append(retry, t)
+			} else {
+				done = append(done, t)
+			}
+
+			continue
+		}
+
+		done = append(done, t)
+
+		log.Printf("### Order %s is now %s\n", t.OrderID, t.Status)
+	}
+
+	// Remove what was done, and release the claim on what should be tried again on the next pass
+	return s.updateSchedule(func(schedule []transition) []transition {
+		pending := []transition{}
+
+		for _, t := range schedule {
+			if containsTransition(done, t) {
+				continue
+			}
+
+			if containsTransition(retry, t) {
+				t.Claimed = time.Time{}
+			}
+
+			pending = append(pending, t)
+		}
+
+		return pending
+	})
+}
+
+// updateSchedule changes the pending transitions with an ETag, so replicas don't overwrite each other's changes
+// change returns the new schedule, or nil if there's nothing to save
+func (s *OrderService) updateSchedule(change func([]transition) []transition) error {
+	return s.updateState(scheduleKey, func(current []byte) (interface{}, bool, error) {
+		schedule := []transition{}
+
+		if current != nil {
+			if err := json.Unmarshal(current, &schedule); err != nil {
+				return nil, false, err
+			}
+		}
+
+		if changed := change(schedule); changed != nil {
+			return changed, true, nil
+		}
+
+		return nil, false, nil
+	})
+}
+
+func containsTransition(list []transition, t transition) bool {
+	for _, other := range list {
+		if other.same(t) {
+			return true
+		}
+	}
+
+	return false
+}
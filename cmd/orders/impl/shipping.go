@@ -0,0 +1,50 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2020
+// Licensed under the MIT License.
+//
+// Shipping orders, and faking their delivery
+// ----------------------------------------------------------------------------
+
+package impl
+
+import (
+	"log"
+
+	"github.com/benc-uk/dapr-store/cmd/orders/spec"
+)
+
+// ShipOrder marks an order as shipped, with the tracking details from the warehouse
+// There is no real carrier, so delivery is faked by scheduling the order to move to delivered then complete
+func (s *OrderService) ShipOrder(orderID string, shipment spec.Shipment) (*spec.Order, error) {
+	order, err := s.GetOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := spec.ValidateShipment(*order, shipment); err != nil {
+		return nil, ShipmentInvalidError(err.Error())
+	}
+
+	if shipment.Address != nil {
+		order.ShippingAddress = shipment.Address
+	}
+
+	order.Carrier = shipment.Carrier
+	order.TrackingNumber = shipment.TrackingNumber
+
+	if err := s.SetStatus(order, spec.OrderShipped); err != nil {
+		return nil, err
+	}
+
+	if err := s.scheduleStatus(order.ID, spec.OrderDelivered, s.deliveryDelay); err != nil {
+		log.Printf("### Warning failed to schedule delivery of order %s: %s", order.ID, err)
+	}
+
+	if err := s.scheduleStatus(order.ID, spec.OrderComplete, s.deliveryDelay+s.completeDelay); err != nil {
+		log.Printf("### Warning failed to schedule completion of order %s: %s", order.ID, err)
+	}
+
+	log.Printf("### Order %s was shipped with %s, tracking number %s", order.ID, order.Carrier, order.TrackingNumber)
+
+	return order, nil
+}
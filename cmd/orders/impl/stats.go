@@ -0,0 +1,144 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2020
+// Licensed under the MIT License.
+//
+// Sales analytics, aggregated per day from order status change events
+// ----------------------------------------------------------------------------
+
+package impl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	dapr "github.com/dapr/go-sdk/client"
+
+	"github.com/benc-uk/dapr-store/cmd/orders/spec"
+	"github.com/benc-uk/go-rest-api/pkg/dapr/pubsub"
+)
+
+// GetStats fetches a summary of sales for a range of days, from & to are both included
+func (s *OrderService) GetStats(from time.Time, to time.Time) (*spec.SalesSummary, error) {
+	keys := []string{}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		keys = append(keys, statsKey(day.Format("2006-01-02")))
+	}
+
+	items, err := s.client.GetBulkState(context.Background(), s.storeName, keys, nil, 10)
+	if err != nil {
+		return nil, err
+	}
+
+	days := []spec.DailyStats{}
+
+	for _, item := range items {
+		if item.Error != "" {
+			return nil, fmt.Errorf("stats %s could not be fetched: %s", item.Key, item.Error)
+		}
+
+		// Days without any orders have nothing stored
+		if item.Value == nil {
+			continue
+		}
+
+		stats := spec.DailyStats{}
+		if err := json.Unmarshal(item.Value, &stats); err != nil {
+			return nil, err
+		}
+
+		days = append(days, stats)
+	}
+
+	summary := spec.Summarise(days, from, to)
+
+	return &summary, nil
+}
+
+// PubSubStatusReceiver is the handler for order status change events, these keep the sales stats up to date
+func (s *OrderService) PubSubStatusReceiver(event *pubsub.CloudEvent) DeliveryStatus {
+	if s.eventProcessed(event.ID) {
+		log.Printf("### Event %s was already counted in stats, ignoring redelivery", event.ID)
+		return DeliverySuccess
+	}
+
+	// Same trick as PubSubOrderReceiver to turn the event.Data map back into an Order
+	var order spec.Order
+
+	jsonData, err := json.Marshal(event.Data)
+	if err == nil {
+		err = json.Unmarshal(jsonData, &order)
+	}
+
+	if err != nil || order.ID == "" {
+		log.Printf("### Error! Event %s does not contain an order, dropping it: %v", event.ID, err)
+		return DeliveryDrop
+	}
+
+	if err := s.recordStats(order); err != nil {
+		log.Printf("### Stats not updated with order %s from event %s, will be retried: %s", order.ID, event.ID, err)
+		return DeliveryRetry
+	}
+
+	s.markEventProcessed(event.ID)
+
+	return DeliverySuccess
+}
+
+// recordStats updates the stats for the day an order was created, when it is paid for or cancelled
+// This is called for every status change, and ignores those that don't affect the stats
+func (s *OrderService) recordStats(order spec.Order) error {
+	var update func(*spec.DailyStats, spec.Order)
+
+	switch {
+	case order.Status == spec.OrderReceived:
+		update = (*spec.DailyStats).AddOrder
+	case order.Status == spec.OrderCancelled && order.Paid():
+		update = (*spec.DailyStats).CancelOrder
+	default:
+		return nil
+	}
+
+	day := spec.StatsDay(order)
+
+	for attempt := 1; ; attempt++ {
+		err := s.updateStats(day, order, update)
+		if err == nil || !isConflict(err) || attempt >= maxSaveAttempts {
+			return err
+		}
+
+		time.Sleep(time.Duration(attempt) * 50 * time.Millisecond)
+	}
+}
+
+// updateStats makes a single attempt at a read-modify-write of the stats for a day, using an ETag
+func (s *OrderService) updateStats(day string, order spec.Order, update func(*spec.DailyStats, spec.Order)) error {
+	data, err := s.client.GetState(context.Background(), s.storeName, statsKey(day), nil)
+	if err != nil {
+		return err
+	}
+
+	stats := &spec.DailyStats{Date: day}
+
+	if data.Value != nil {
+		if err := json.Unmarshal(data.Value, stats); err != nil {
+			return err
+		}
+	}
+
+	update(stats, order)
+
+	jsonPayload, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+
+	return s.client.SaveStateWithETag(context.Background(), s.storeName, statsKey(day), jsonPayload, data.Etag, nil,
+		dapr.WithConcurrency(dapr.StateConcurrencyFirstWrite))
+}
+
+func statsKey(day string) string {
+	return "stats-" + day
+}
@@ -0,0 +1,106 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2020
+// Licensed under the MIT License.
+//
+// Watching orders for status changes, wherever they were made
+// ----------------------------------------------------------------------------
+
+package impl
+
+import (
+	"log"
+	"time"
+
+	"github.com/benc-uk/dapr-store/cmd/orders/spec"
+)
+
+// How often watched orders are fetched from the state store
+const watchPollInterval = 2 * time.Second
+
+// WatchOrder subscribes to changes of an order, each time the status is set the updated order is sent on the channel
+// The returned func must be called to unsubscribe, which also closes the channel
+// Changes made by this instance are sent straight away, the state store has no change feed so changes made by
+// other replicas are found by polling. The same change can be sent twice, once each way
+func (s *OrderService) WatchOrder(orderID string) (<-chan spec.Order, func()) {
+	s.watchLock.Lock()
+	defer s.watchLock.Unlock()
+
+	updates := make(chan spec.Order, 10)
+	s.watchers[orderID] = append(s.watchers[orderID], updates)
+
+	// One poller per order, however many are watching it
+	if s.pollers[orderID] == nil {
+		s.pollers[orderID] = make(chan struct{})
+		go s.pollOrder(orderID, s.pollers[orderID])
+	}
+
+	stop := func() {
+		s.watchLock.Lock()
+		defer s.watchLock.Unlock()
+
+		remaining := []chan spec.Order{}
+
+		for _, w := range s.watchers[orderID] {
+			if w == updates {
+				close(w)
+				continue
+			}
+
+			remaining = append(remaining, w)
+		}
+
+		if len(remaining) == 0 {
+			delete(s.watchers, orderID)
+
+			if s.pollers[orderID] != nil {
+				close(s.pollers[orderID])
+				delete(s.pollers, orderID)
+			}
+		} else {
+			s.watchers[orderID] = remaining
+		}
+	}
+
+	return updates, stop
+}
+
+// notifyWatchers sends an updated order to everyone watching it
+// Slow watchers with a full channel miss the update, rather than holding up the service
+func (s *OrderService) notifyWatchers(order spec.Order) {
+	s.watchLock.Lock()
+	defer s.watchLock.Unlock()
+
+	for _, w := range s.watchers[order.ID] {
+		select {
+		case w <- order:
+		default:
+		}
+	}
+}
+
+// pollOrder fetches an order until told to stop, notifying watchers whenever its history has grown
+func (s *OrderService) pollOrder(orderID string, stop <-chan struct{}) {
+	ticker := time.NewTicker(s.watchPoll)
+	defer ticker.Stop()
+
+	seen := -1
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		order, err := s.GetOrder(orderID)
+		if err != nil {
+			log.Printf("### Warning unable to poll watched order %s: %s", orderID, err)
+			continue
+		}
+
+		if len(order.History) != seen {
+			seen = len(order.History)
+			s.notifyWatchers(*order)
+		}
+	}
+}
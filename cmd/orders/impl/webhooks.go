@@ -0,0 +1,320 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2020
+// Licensed under the MIT License.
+//
+// Outbound webhooks, notifying subscribers of order status changes
+// ----------------------------------------------------------------------------
+
+package impl
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/benc-uk/dapr-store/cmd/orders/spec"
+)
+
+// Key in the state store holding all webhook subscriptions
+const webhooksKey = "orders-webhooks"
+
+// Header holding the HMAC-SHA256 signature of the payload, so receivers can check it came from us
+const SignatureHeader = "X-Dapr-Store-Signature"
+
+const (
+	webhookAttempts   = 5               // Deliveries are tried this many times before giving up
+	webhookBackoff    = 2 * time.Second // Wait before the first retry, doubled for each one after
+	webhookMaxLogSize = 100             // Only the most recent deliveries are logged for each webhook
+)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// AddWebhook registers a new webhook, a secret for signing is generated if one isn't given
+func (s *OrderService) AddWebhook(hook spec.Webhook) (*spec.Webhook, error) {
+	if err := spec.ValidateWebhook(hook); err != nil {
+		return nil, WebhookInvalidError(err.Error())
+	}
+
+	hook.ID = randomHex(8)
+	hook.Created = time.Now().UTC()
+
+	if hook.Secret == "" {
+		hook.Secret = randomHex(32)
+	}
+
+	err := s.updateWebhooks(func(hooks []spec.Webhook) []spec.Webhook {
+		return append(hooks, hook)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("### Webhook %s added for %s", hook.ID, hook.URL)
+
+	return &hook, nil
+}
+
+// GetWebhooks lists all webhooks, without their secrets
+func (s *OrderService) GetWebhooks() ([]spec.Webhook, error) {
+	hooks, err := s.loadWebhooks()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+
+	return hooks, nil
+}
+
+// DeleteWebhook removes a webhook, and its delivery log
+func (s *OrderService) DeleteWebhook(id string) error {
+	found := false
+
+	err := s.updateWebhooks(func(hooks []spec.Webhook) []spec.Webhook {
+		kept := []spec.Webhook{}
+
+		for _, h := range hooks {
+			if h.ID != id {
+				kept = append(kept, h)
+			}
+		}
+
+		found = len(kept) < len(hooks)
+		if !found {
+			return nil
+		}
+
+		return kept
+	})
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return WebhookNotFoundError()
+	}
+
+	_ = s.client.DeleteState(context.Background(), s.storeName, deliveriesKey(id), nil)
+
+	return nil
+}
+
+// GetWebhookDeliveries fetches the log of recent deliveries to a webhook, newest last
+func (s *OrderService) GetWebhookDeliveries(id string) ([]spec.WebhookDelivery, error) {
+	hooks, err := s.loadWebhooks()
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+
+	for _, h := range hooks {
+		if h.ID == id {
+			found = true
+		}
+	}
+
+	if !found {
+		return nil, WebhookNotFoundError()
+	}
+
+	return s.loadDeliveries(id)
+}
+
+// dispatchWebhooks sends an order event to every webhook that wants it
+// Delivery happens in the background, so the status change is never held up by slow receivers
+// NOTE Retries are in memory, any still pending when the service stops are lost
+func (s *OrderService) dispatchWebhooks(order spec.Order) {
+	hooks, err := s.loadWebhooks()
+	if err != nil {
+		log.Printf("### Error! Unable to load webhooks for order %s: %s", order.ID, err)
+		return
+	}
+
+	event := spec.WebhookEvent{
+		Type:  spec.EventType(order.Status),
+		Order: order,
+		At:    time.Now().UTC(),
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("### Error! Unable to create webhook payload for order %s: %s", order.ID, err)
+		return
+	}
+
+	for _, hook := range hooks {
+		if hook.Wants(event.Type) {
+			go s.deliverWebhook(hook, event, payload)
+		}
+	}
+}
+
+// deliverWebhook POSTs the payload to a webhook, retrying with backoff until it succeeds or we give up
+func (s *OrderService) deliverWebhook(hook spec.Webhook, event spec.WebhookEvent, payload []byte) {
+	backoff := webhookBackoff
+
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		delivery := spec.WebhookDelivery{
+			WebhookID: hook.ID,
+			Event:     event.Type,
+			OrderID:   event.Order.ID,
+			Attempt:   attempt,
+			At:        time.Now().UTC(),
+		}
+
+		statusCode, err := postWebhook(hook, payload)
+		delivery.StatusCode = statusCode
+		delivery.Success = err == nil
+
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+
+		s.logDelivery(delivery)
+
+		if delivery.Success {
+			return
+		}
+
+		if attempt < webhookAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	log.Printf("### Error! Gave up delivering %s to webhook %s", event.Type, hook.ID)
+}
+
+// postWebhook makes a single signed request to a webhook, anything other than a 2xx response is an error
+func postWebhook(hook spec.Webhook, payload []byte) (int, error) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, "sha256="+Sign(payload, hook.Secret))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// Sign creates the hex encoded HMAC-SHA256 of a payload, using the webhook secret
+func Sign(payload []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// logDelivery adds to the delivery log of a webhook, trimming the oldest entries
+func (s *OrderService) logDelivery(delivery spec.WebhookDelivery) {
+	err := s.updateState(deliveriesKey(delivery.WebhookID), func(current []byte) (interface{}, bool, error) {
+		deliveries := []spec.WebhookDelivery{}
+
+		if current != nil {
+			if err := json.Unmarshal(current, &deliveries); err != nil {
+				return nil, false, err
+			}
+		}
+
+		deliveries = append(deliveries, delivery)
+		if len(deliveries) > webhookMaxLogSize {
+			deliveries = deliveries[len(deliveries)-webhookMaxLogSize:]
+		}
+
+		return deliveries, true, nil
+	})
+	if err != nil {
+		log.Printf("### Warning failed to log delivery to webhook %s: %s", delivery.WebhookID, err)
+	}
+}
+
+func (s *OrderService) loadDeliveries(id string) ([]spec.WebhookDelivery, error) {
+	data, err := s.client.GetState(context.Background(), s.storeName, deliveriesKey(id), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := []spec.WebhookDelivery{}
+
+	if data.Value == nil {
+		return deliveries, nil
+	}
+
+	if err := json.Unmarshal(data.Value, &deliveries); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+func (s *OrderService) loadWebhooks() ([]spec.Webhook, error) {
+	data, err := s.client.GetState(context.Background(), s.storeName, webhooksKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := []spec.Webhook{}
+
+	if data.Value == nil {
+		return hooks, nil
+	}
+
+	if err := json.Unmarshal(data.Value, &hooks); err != nil {
+		return nil, err
+	}
+
+	return hooks, nil
+}
+
+// updateWebhooks changes the webhooks with an ETag, change returns the new list or nil to leave it
+func (s *OrderService) updateWebhooks(change func([]spec.Webhook) []spec.Webhook) error {
+	return s.updateState(webhooksKey, func(current []byte) (interface{}, bool, error) {
+		hooks := []spec.Webhook{}
+
+		if current != nil {
+			if err := json.Unmarshal(current, &hooks); err != nil {
+				return nil, false, err
+			}
+		}
+
+		if changed := change(hooks); changed != nil {
+			return changed, true, nil
+		}
+
+		return nil, false, nil
+	})
+}
+
+func deliveriesKey(webhookID string) string {
+	return "webhook-deliveries-" + webhookID
+}
+
+// Random hex string from n random bytes, used for IDs and secrets
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
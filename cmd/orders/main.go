@@ -8,7 +8,9 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"regexp"
 	"time"
@@ -42,6 +44,16 @@ var (
 
 // Main entry point, will start HTTP service
 func main() {
+	// Running as 'orders export' does a one off export of orders, rather than starting the service
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		os.Exit(runExport(os.Args[2:]))
+	}
+
+	// Running as 'orders backfill' adds old orders to the daily index used by export
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		os.Exit(runBackfill(os.Args[2:]))
+	}
+
 	log.SetOutput(os.Stdout) // Personal preference on log output
 
 	// Port to listen on, change the default as you see fit
@@ -50,6 +62,7 @@ func main() {
 	// Needed for pub sub
 	pubSubName := env.GetEnvString("DAPR_PUBSUB_NAME", "pubsub")
 	topicName := env.GetEnvString("DAPR_ORDERS_TOPIC", "orders-queue")
+	statusTopicName := env.GetEnvString("DAPR_STATUS_TOPIC", "orders-status")
 
 	// Use chi for routing
 	router := chi.NewRouter()
@@ -90,12 +103,26 @@ func main() {
 	api.AddOKEndpoint(router, "")
 
 	// Special Dapr endpoints added to the router to support pub/sub
-	pubsub.Subscribe(pubSubName, []string{topicName}, router)
-	pubsub.AddTopicHandler(topicName, router, svc.PubSubOrderReceiver)
+	pubsub.Subscribe(pubSubName, []string{topicName, statusTopicName}, router)
+	addOrderTopicHandler(topicName, router, svc.PubSubOrderReceiver)
+	addOrderTopicHandler(statusTopicName, router, svc.PubSubStatusReceiver)
+
+	// Background loop moving orders through their statuses, also resumes any left from a previous run
+	go svc.RunScheduler(5 * time.Second)
 
 	// Add application routes for this service
 	api.addRoutes(router, validator)
 
 	// Finally start the server
-	api.StartServer(serverPort, router, 5*time.Second)
+	// This can't use api.StartServer, its write timeout would cut off clients watching orders
+	srv := &http.Server{
+		Handler:     router,
+		Addr:        fmt.Sprintf(":%d", serverPort),
+		ReadTimeout: 5 * time.Second,
+		IdleTimeout: 5 * time.Second,
+	}
+
+	log.Printf("### 🌐 %s API, listening on port: %d", serviceName, serverPort)
+	log.Printf("### 🚀 Build details: v%s (%s)", version, buildInfo)
+	log.Fatal(srv.ListenAndServe())
 }
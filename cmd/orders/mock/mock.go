@@ -3,8 +3,11 @@ package mock
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/benc-uk/dapr-store/cmd/orders/impl"
@@ -17,7 +20,14 @@ type OrderService struct {
 
 // MockOrders is some fake orders loaded from file
 var MockOrders []orderspec.Order
+
+// Guards MockOrders, which the fake background processing changes while tests are reading it
+var mockLock sync.Mutex
+
 var mockUserOrders []string
+var mockReturns []orderspec.Return
+var mockDeadLetters []orderspec.DeadLetter
+var mockWebhooks []orderspec.Webhook
 
 func init() {
 	mockJSON, err := os.ReadFile("../../testing/mock-data/orders.json")
@@ -39,22 +49,47 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+
+	mockDeadLetters = []orderspec.DeadLetter{
+		{ID: "evt-mock", Order: orderspec.Order{ID: "ord-bad"}, Reason: "order failed validation"},
+	}
 }
 
 // GetOrder mock
 func (s OrderService) GetOrder(orderID string) (*orderspec.Order, error) {
-	if orderID == MockOrders[0].ID {
-		return &MockOrders[0], nil
+	if order := mockOrders()[0]; orderID == order.ID {
+		return &order, nil
 	}
 
 	return nil, impl.OrderNotFoundError()
 }
 
+// mockOrders gives a copy of the mock orders, safe from any changes made in the background
+func mockOrders() []orderspec.Order {
+	mockLock.Lock()
+	defer mockLock.Unlock()
+
+	return append([]orderspec.Order{}, MockOrders...)
+}
+
 // GetOrdersForUser mock
 func (s OrderService) GetOrdersForUser(userID string) ([]string, error) {
 	return nil, nil
 }
 
+// GetOrderHistory mock
+func (s OrderService) GetOrderHistory(userID string, query orderspec.OrderQuery) (*orderspec.OrderPage, error) {
+	orders := []orderspec.Order{}
+
+	for _, o := range mockOrders() {
+		if o.ForUserID == userID {
+			orders = append(orders, o)
+		}
+	}
+
+	return orderspec.QueryOrders(orders, query), nil
+}
+
 // ProcessOrder mock
 func (s OrderService) ProcessOrder(order orderspec.Order) error {
 	err := orderspec.Validate(order)
@@ -72,6 +107,8 @@ func (s OrderService) ProcessOrder(order orderspec.Order) error {
 		return prob
 	}
 
+	order.PaymentRef = "mock-payment"
+
 	_ = s.SetStatus(&order, orderspec.OrderReceived)
 
 	log.Printf("### Order %s was saved to state store\n", order.ID)
@@ -83,33 +120,362 @@ func (s OrderService) ProcessOrder(order orderspec.Order) error {
 	_ = s.EmailNotify(order)
 	_ = s.SaveReport(order)
 
-	// Fake background order processing
+	// Fake background order processing, the order then waits to be shipped
 	time.AfterFunc(1*time.Second, func() {
 		_ = s.SetStatus(&order, orderspec.OrderProcessing)
 	})
 
-	// Fake background order completion
-	time.AfterFunc(2*time.Second, func() {
-		_ = s.SetStatus(&order, orderspec.OrderComplete)
-	})
-
 	return nil
 }
 
 // AddOrder mock
 func (s OrderService) AddOrder(order orderspec.Order) error {
+	mockLock.Lock()
+	defer mockLock.Unlock()
+
 	MockOrders = append(MockOrders, order)
+
 	return nil
 }
 
 // SetStatus mock
 func (s OrderService) SetStatus(order *orderspec.Order, status orderspec.OrderStatus) error {
-	order.Status = status
+	if err := order.Transition(status); err != nil {
+		return err
+	}
+
+	mockLock.Lock()
+	defer mockLock.Unlock()
+
 	MockOrders[0] = *order
 
 	return nil
 }
 
+// CancelOrder mock, the cancelled order is returned but not stored
+func (s OrderService) CancelOrder(orderID string) (*orderspec.Order, error) {
+	order, err := s.GetOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	cancelled := *order
+	if err := cancelled.Transition(orderspec.OrderCancelled); err != nil {
+		return nil, err
+	}
+
+	if cancelled.PaymentRef != "" {
+		cancelled.RefundRef = "fake-refund-" + cancelled.ID
+	}
+
+	return &cancelled, nil
+}
+
+// GetInvoice mock
+func (s OrderService) GetInvoice(orderID string) (*orderspec.Invoice, error) {
+	order, err := s.GetOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !order.Invoiceable() {
+		return nil, impl.InvoiceUnavailableError()
+	}
+
+	seller := orderspec.Seller{Name: "Dapr Store", Address: []string{"1 Mock Street"}}
+	customer := orderspec.Customer{UserID: order.ForUserID}
+	invoice := orderspec.NewInvoice("INV-000001", *order, seller, customer, 20, "£", order.Created)
+
+	return &invoice, nil
+}
+
+// GetStats mock, every mock order is counted as paid
+func (s OrderService) GetStats(from time.Time, to time.Time) (*orderspec.SalesSummary, error) {
+	days := map[string]*orderspec.DailyStats{}
+
+	for _, o := range mockOrders() {
+		day := orderspec.StatsDay(o)
+		if days[day] == nil {
+			days[day] = &orderspec.DailyStats{Date: day}
+		}
+
+		days[day].AddOrder(o)
+	}
+
+	stats := []orderspec.DailyStats{}
+	for _, d := range days {
+		stats = append(stats, *d)
+	}
+
+	summary := orderspec.Summarise(stats, from, to)
+
+	return &summary, nil
+}
+
+// ExportOrders mock
+func (s OrderService) ExportOrders(w io.Writer, query orderspec.OrderQuery, format string) (int, error) {
+	if impl.ExportContentType(format) == "" {
+		return 0, impl.ExportInvalidError("format must be csv or ndjson")
+	}
+
+	rows := impl.NewExportWriter(w, format)
+	if err := rows.Header(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+
+	for _, o := range mockOrders() {
+		if !query.Matches(o) {
+			continue
+		}
+
+		for _, row := range orderspec.ExportRows(o) {
+			if err := rows.Write(row); err != nil {
+				return count, err
+			}
+		}
+
+		count++
+	}
+
+	return count, rows.Flush()
+}
+
+// ShipOrder mock, with fake delivery & completion soon after
+func (s OrderService) ShipOrder(orderID string, shipment orderspec.Shipment) (*orderspec.Order, error) {
+	order, err := s.GetOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := orderspec.ValidateShipment(*order, shipment); err != nil {
+		return nil, impl.ShipmentInvalidError(err.Error())
+	}
+
+	shipped := *order
+	if shipment.Address != nil {
+		shipped.ShippingAddress = shipment.Address
+	}
+
+	shipped.Carrier = shipment.Carrier
+	shipped.TrackingNumber = shipment.TrackingNumber
+
+	if err := s.SetStatus(&shipped, orderspec.OrderShipped); err != nil {
+		return nil, err
+	}
+
+	time.AfterFunc(500*time.Millisecond, func() {
+		delivered := mockOrders()[0]
+		_ = s.SetStatus(&delivered, orderspec.OrderDelivered)
+	})
+
+	time.AfterFunc(1*time.Second, func() {
+		completed := mockOrders()[0]
+		_ = s.SetStatus(&completed, orderspec.OrderComplete)
+	})
+
+	return &shipped, nil
+}
+
+// GetHeldOrders mock
+func (s OrderService) GetHeldOrders() ([]orderspec.Order, error) {
+	held := []orderspec.Order{}
+
+	for _, o := range mockOrders() {
+		if o.Status == orderspec.OrderOnHold {
+			held = append(held, o)
+		}
+	}
+
+	return held, nil
+}
+
+// ReviewOrder mock, the reviewed order is returned but not stored
+func (s OrderService) ReviewOrder(orderID string, release bool) (*orderspec.Order, error) {
+	order, err := s.GetOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if order.Status != orderspec.OrderOnHold {
+		return nil, impl.OrderNotHeldError()
+	}
+
+	reviewed := *order
+	status := orderspec.OrderCancelled
+
+	if release {
+		reviewed.PaymentRef = "mock-payment"
+		status = orderspec.OrderReceived
+	}
+
+	if err := reviewed.Transition(status); err != nil {
+		return nil, err
+	}
+
+	return &reviewed, nil
+}
+
+// CreateReturn mock
+func (s OrderService) CreateReturn(orderID string, items []orderspec.ReturnItem, reason string) (*orderspec.Return, error) {
+	order, err := s.GetOrder(orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if order.Status != orderspec.OrderComplete && order.Status != orderspec.OrderPartiallyRefunded {
+		return nil, impl.OrderStatusError()
+	}
+
+	refund, err := orderspec.Refund(*order, items, orderspec.ReturnedCounts(mockReturns))
+	if err != nil {
+		return nil, impl.ReturnInvalidError(err.Error())
+	}
+
+	ret := orderspec.Return{
+		ID:           fmt.Sprintf("%s-R%d", orderID, len(mockReturns)+1),
+		OrderID:      orderID,
+		Items:        items,
+		Reason:       reason,
+		Status:       orderspec.ReturnRequested,
+		RefundAmount: refund,
+	}
+	mockReturns = append(mockReturns, ret)
+
+	return &ret, nil
+}
+
+// GetReturns mock
+func (s OrderService) GetReturns(orderID string) ([]orderspec.Return, error) {
+	returns := []orderspec.Return{}
+
+	for _, r := range mockReturns {
+		if r.OrderID == orderID {
+			returns = append(returns, r)
+		}
+	}
+
+	return returns, nil
+}
+
+// ResolveReturn mock
+func (s OrderService) ResolveReturn(returnID string, approve bool) (*orderspec.Return, error) {
+	for i, r := range mockReturns {
+		if r.ID != returnID {
+			continue
+		}
+
+		if r.Status != orderspec.ReturnRequested {
+			return nil, impl.ReturnStatusError()
+		}
+
+		mockReturns[i].Status = orderspec.ReturnRejected
+
+		if approve {
+			mockReturns[i].Status = orderspec.ReturnApproved
+			mockReturns[i].RefundRef = fmt.Sprintf("fake-refund-%s-%.2f", r.OrderID, r.RefundAmount)
+			approved := orderspec.ReturnedCounts(mockReturns)
+
+			order := mockOrders()[0]
+			status := orderspec.OrderPartiallyRefunded
+
+			if orderspec.FullyReturned(order, approved) {
+				status = orderspec.OrderReturned
+			}
+
+			if err := s.SetStatus(&order, status); err != nil {
+				return nil, err
+			}
+		}
+
+		return &mockReturns[i], nil
+	}
+
+	return nil, impl.ReturnNotFoundError()
+}
+
+// GetDeadLetters mock
+func (s OrderService) GetDeadLetters() ([]orderspec.DeadLetter, error) {
+	return mockDeadLetters, nil
+}
+
+// ReplayDeadLetter mock
+func (s OrderService) ReplayDeadLetter(id string, fixed *orderspec.Order) (*orderspec.Order, error) {
+	for _, l := range mockDeadLetters {
+		if l.ID != id {
+			continue
+		}
+
+		if fixed != nil {
+			return fixed, nil
+		}
+
+		return &l.Order, nil
+	}
+
+	return nil, impl.DeadLetterNotFoundError()
+}
+
+// WatchOrder mock, the channel is already closed so there are never any changes
+func (s OrderService) WatchOrder(orderID string) (<-chan orderspec.Order, func()) {
+	updates := make(chan orderspec.Order)
+	close(updates)
+
+	return updates, func() {}
+}
+
+// AddWebhook mock
+func (s OrderService) AddWebhook(hook orderspec.Webhook) (*orderspec.Webhook, error) {
+	if err := orderspec.ValidateWebhook(hook); err != nil {
+		return nil, impl.WebhookInvalidError(err.Error())
+	}
+
+	hook.ID = fmt.Sprintf("hook-%d", len(mockWebhooks)+1)
+	if hook.Secret == "" {
+		hook.Secret = "mock-secret"
+	}
+
+	mockWebhooks = append(mockWebhooks, hook)
+
+	return &hook, nil
+}
+
+// GetWebhooks mock
+func (s OrderService) GetWebhooks() ([]orderspec.Webhook, error) {
+	hooks := []orderspec.Webhook{}
+
+	for _, h := range mockWebhooks {
+		h.Secret = ""
+		hooks = append(hooks, h)
+	}
+
+	return hooks, nil
+}
+
+// DeleteWebhook mock
+func (s OrderService) DeleteWebhook(id string) error {
+	for i, h := range mockWebhooks {
+		if h.ID == id {
+			mockWebhooks = append(mockWebhooks[:i], mockWebhooks[i+1:]...)
+			return nil
+		}
+	}
+
+	return impl.WebhookNotFoundError()
+}
+
+// GetWebhookDeliveries mock
+func (s OrderService) GetWebhookDeliveries(id string) ([]orderspec.WebhookDelivery, error) {
+	for _, h := range mockWebhooks {
+		if h.ID == id {
+			return []orderspec.WebhookDelivery{}, nil
+		}
+	}
+
+	return nil, impl.WebhookNotFoundError()
+}
+
 // EmailNotify mock
 func (s OrderService) EmailNotify(orderspec.Order) error {
 	return nil
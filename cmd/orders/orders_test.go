@@ -8,16 +8,21 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"log"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/benc-uk/dapr-store/cmd/orders/impl"
 	"github.com/benc-uk/dapr-store/cmd/orders/mock"
 	"github.com/benc-uk/dapr-store/cmd/orders/spec"
+	userspec "github.com/benc-uk/dapr-store/cmd/users/spec"
 	"github.com/benc-uk/go-rest-api/pkg/api"
 	"github.com/benc-uk/go-rest-api/pkg/auth"
+	"github.com/benc-uk/go-rest-api/pkg/dapr/pubsub"
 	"github.com/benc-uk/go-rest-api/pkg/httptester"
 	"github.com/go-chi/chi/v5"
 )
@@ -35,6 +40,15 @@ func TestOrders(t *testing.T) {
 	}
 	api.addRoutes(router, auth.NewPassthroughValidator())
 
+	// Fake receiver, just to check the pub/sub handler passes on delivery status
+	addOrderTopicHandler("test-topic", router, func(event *pubsub.CloudEvent) impl.DeliveryStatus {
+		if event.ID == "evt-retry" {
+			return impl.DeliveryRetry
+		}
+
+		return impl.DeliverySuccess
+	})
+
 	httptester.Run(t, router, testCases)
 
 	// Rest of tests don't go through the router/api
@@ -68,6 +82,257 @@ func TestOrders(t *testing.T) {
 		}
 	})
 
+	t.Run("fake payment approved", func(t *testing.T) {
+		ref, err := impl.NewFakePaymentProvider(impl.PaymentApprove).Charge(context.Background(), mock.MockOrders[0])
+		if err != nil || ref == "" {
+			t.Errorf("'fake payment approved' failed: %+v", err)
+		}
+	})
+
+	t.Run("fake payment declined", func(t *testing.T) {
+		_, err := impl.NewFakePaymentProvider(impl.PaymentDecline).Charge(context.Background(), mock.MockOrders[0])
+		if err == nil || !strings.Contains(err.Error(), "declined") {
+			t.Errorf("'fake payment declined' failed: %+v", err)
+		}
+	})
+
+	t.Run("fake payment timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		_, err := impl.NewFakePaymentProvider(impl.PaymentTimeout).Charge(ctx, mock.MockOrders[0])
+		if err == nil || !strings.Contains(err.Error(), "deadline") {
+			t.Errorf("'fake payment timeout' failed: %+v", err)
+		}
+	})
+
+	t.Run("fake refund", func(t *testing.T) {
+		ref, err := impl.NewFakePaymentProvider(impl.PaymentDecline).Refund(context.Background(), mock.MockOrders[0], 5)
+		if err != nil || !strings.HasSuffix(ref, "-5.00") {
+			t.Errorf("'fake refund' failed: %s %+v", ref, err)
+		}
+	})
+
+	t.Run("fraud rules screening", func(t *testing.T) {
+		rules := spec.FraudRules{MaxAmount: 100, MaxOrdersPerHour: 3, MaxQuantity: 5}
+		order := mock.MockOrders[0]
+		order.LineItems = append([]spec.LineItem{}, order.LineItems[:1]...)
+
+		if reasons := rules.Screen(order, 2); len(reasons) != 0 {
+			t.Errorf("'fraud rules screening' held a normal order: %+v", reasons)
+		}
+
+		order.Amount = 500
+		order.LineItems[0].Count = 10
+
+		if reasons := rules.Screen(order, 3); len(reasons) != 3 {
+			t.Errorf("'fraud rules screening' expected 3 reasons, got: %+v", reasons)
+		}
+
+		if reasons := (spec.FraudRules{}).Screen(order, 100); len(reasons) != 0 {
+			t.Errorf("'fraud rules screening' rules turned off but order held: %+v", reasons)
+		}
+	})
+
+	t.Run("render order email", func(t *testing.T) {
+		order := mock.MockOrders[0]
+		order.Title = "<b>Sneaky</b>"
+		order.Status = spec.OrderReceived
+		user := userspec.User{DisplayName: "Mock User"}
+
+		email, err := impl.NewEmailRenderer("", "€").Render(order, user)
+		if err != nil {
+			t.Fatalf("'render order email' failed: %+v", err)
+		}
+
+		if !strings.Contains(email.HTML, "&lt;b&gt;Sneaky&lt;/b&gt;") || !strings.Contains(email.HTML, "€22.40") ||
+			!strings.Contains(email.Text, "Paisley Cravat Ascot Tie x 2 @ €11.20 = €22.40") ||
+			email.Subject != "Dapr Store, order details: <b>Sneaky</b>" {
+			t.Errorf("'render order email' failed: %+v", email)
+		}
+
+		body, contentType, err := email.Multipart()
+		if err != nil || !strings.HasPrefix(contentType, "multipart/alternative; boundary=") || !strings.Contains(string(body), "text/plain") {
+			t.Errorf("'render order email' multipart failed: %+v", err)
+		}
+	})
+
+	t.Run("render shipped email", func(t *testing.T) {
+		order := mock.MockOrders[0]
+		order.Status = spec.OrderShipped
+		order.Carrier, order.TrackingNumber = "Royal Mail", "RM123"
+
+		email, err := impl.NewEmailRenderer("", "£").Render(order, userspec.User{})
+		if err != nil || !strings.Contains(email.Text, "delivered by Royal Mail, your tracking number is RM123") || !strings.Contains(email.HTML, "<b>RM123</b>") {
+			t.Errorf("'render shipped email' failed: %+v", err)
+		}
+	})
+
+	t.Run("render cancelled email", func(t *testing.T) {
+		order := mock.MockOrders[0]
+		order.Status = spec.OrderCancelled
+		order.PaymentRef, order.RefundRef = "", ""
+		order.History = nil
+		renderer := impl.NewEmailRenderer("", "£")
+
+		unpaid, err := renderer.Render(order, userspec.User{})
+		if err != nil || !strings.Contains(unpaid.Text, "you have not been charged") {
+			t.Errorf("'render cancelled email' unpaid failed: %+v", err)
+		}
+
+		order.PaymentRef = "pay-1"
+
+		paid, err := renderer.Render(order, userspec.User{})
+		if err != nil || !strings.Contains(paid.Text, "£22.40 you paid will be refunded") || strings.Contains(paid.HTML, "not been charged") {
+			t.Errorf("'render cancelled email' paid failed: %+v", err)
+		}
+
+		order.RefundRef = "refund-1"
+
+		refunded, err := renderer.Render(order, userspec.User{})
+		if err != nil || !strings.Contains(refunded.Text, "has been refunded. Your refund reference is refund-1") || !strings.Contains(refunded.HTML, "<b>refund-1</b>") {
+			t.Errorf("'render cancelled email' refunded failed: %+v", err)
+		}
+	})
+
+	t.Run("no email for status", func(t *testing.T) {
+		order := mock.MockOrders[0]
+		order.Status = spec.OrderProcessing
+
+		_, err := impl.NewEmailRenderer("", "£").Render(order, userspec.User{})
+		if err == nil {
+			t.Error("'no email for status' failed")
+		}
+	})
+
+	t.Run("render order reports", func(t *testing.T) {
+		expect := map[string][]string{
+			impl.ReportJSON: {"application/json", `"unitPrice": 11.2`, `"lineTotal": 22.4`},
+			impl.ReportCSV:  {"text/csv", "Paisley Cravat Ascot Tie,2,11.20,22.40", "TOTAL,,,22.40"},
+			impl.ReportHTML: {"text/html", "<td>11.20</td><td>22.40</td>", "<th>22.40</th>"},
+		}
+
+		for format, want := range expect {
+			renderer := impl.NewReportRenderer(format)
+
+			report, err := renderer.Render(mock.MockOrders[0])
+			if err != nil || renderer.ContentType() != want[0] || renderer.Extension() != format {
+				t.Errorf("'render order reports' %s failed: %+v", format, err)
+			}
+
+			for _, w := range want[1:] {
+				if !strings.Contains(string(report), w) {
+					t.Errorf("'render order reports' %s missing '%s' in:\n%s", format, w, report)
+				}
+			}
+		}
+	})
+
+	t.Run("invoice tax breakdown", func(t *testing.T) {
+		order := mock.MockOrders[0]
+		order.Status = spec.OrderComplete
+		seller := spec.Seller{Name: "Dapr (Store)", Address: []string{"1 Mock Street"}, TaxID: "GB123"}
+
+		invoice := spec.NewInvoice("INV-000042", order, seller, spec.Customer{UserID: "mock@example.net"}, 20, "£", time.Now())
+		if invoice.Net != 18.67 || invoice.Tax != 3.73 || invoice.Total != 22.40 || len(invoice.Taxes) != 1 || invoice.Taxes[0].Rate != 20 {
+			t.Errorf("'invoice tax breakdown' failed: %+v", invoice)
+		}
+
+		html, err := impl.RenderInvoiceHTML(invoice)
+		if err != nil || !strings.Contains(string(html), "INV-000042") || !strings.Contains(string(html), "£18.67") ||
+			!strings.Contains(string(html), "<td>20%</td>") {
+			t.Errorf("'invoice tax breakdown' HTML failed: %+v\n%s", err, html)
+		}
+
+		pdf := string(impl.RenderInvoicePDF(invoice))
+		xref := strings.Index(pdf, "xref\n")
+
+		if !strings.HasPrefix(pdf, "%PDF-1.4") || !strings.HasSuffix(pdf, "%%EOF\n") || !strings.Contains(pdf, "(Dapr \\(Store\\)) Tj") ||
+			!strings.Contains(pdf, "(Invoice number: INV-000042) Tj") || !strings.Contains(pdf, fmt.Sprintf("startxref\n%d\n", xref)) {
+			t.Errorf("'invoice tax breakdown' PDF failed:\n%s", pdf)
+		}
+	})
+
+	t.Run("invoiceable only once paid", func(t *testing.T) {
+		held := spec.Order{ID: "ord-held", Status: spec.OrderNew}
+		_ = held.Transition(spec.OrderOnHold)
+
+		if held.Invoiceable() {
+			t.Errorf("'invoiceable only once paid' on hold order is invoiceable: %+v", held)
+		}
+
+		_ = held.Transition(spec.OrderCancelled)
+
+		if held.Invoiceable() {
+			t.Errorf("'invoiceable only once paid' order cancelled from hold is invoiceable: %+v", held)
+		}
+
+		released := spec.Order{ID: "ord-released", Status: spec.OrderNew}
+		_ = released.Transition(spec.OrderOnHold)
+		released.PaymentRef = "fake-ord-released"
+		_ = released.Transition(spec.OrderReceived)
+		_ = released.Transition(spec.OrderCancelled)
+
+		if !released.Invoiceable() {
+			t.Errorf("'invoiceable only once paid' paid order is not invoiceable: %+v", released)
+		}
+	})
+
+	t.Run("sales stats summarised", func(t *testing.T) {
+		day1, day3 := time.Date(2023, 1, 1, 9, 0, 0, 0, time.UTC), time.Date(2023, 1, 3, 23, 0, 0, 0, time.UTC)
+		tie := mock.MockOrders[0].LineItems[0].Product
+		hat := tie
+		hat.ID, hat.Name, hat.Cost = "hat", "Hat", 5
+
+		orders := []spec.Order{
+			{ID: "a", Amount: 22.4, Created: day1, LineItems: []spec.LineItem{{Count: 2, Product: tie}}},
+			{ID: "b", Amount: 15, Created: day1, LineItems: []spec.LineItem{{Count: 3, Product: hat}}},
+			{ID: "c", Amount: 11.2, Created: day3, LineItems: []spec.LineItem{{Count: 1, Product: tie}}},
+		}
+
+		days := map[string]*spec.DailyStats{}
+		for _, o := range orders {
+			day := spec.StatsDay(o)
+			if days[day] == nil {
+				days[day] = &spec.DailyStats{Date: day}
+			}
+
+			days[day].AddOrder(o)
+		}
+
+		days["2023-01-01"].CancelOrder(orders[1])
+
+		summary := spec.Summarise([]spec.DailyStats{*days["2023-01-01"], *days["2023-01-03"]}, day1.Truncate(24*time.Hour), day3.Truncate(24*time.Hour))
+		if summary.Orders != 3 || summary.Cancelled != 1 || summary.Revenue != 33.6 || summary.AverageBasket != 16.8 || summary.AverageItems != 1.5 ||
+			len(summary.Days) != 3 || summary.Days[1].Orders != 0 || len(summary.TopProducts) != 1 || summary.TopProducts[0].Count != 3 {
+			t.Errorf("'sales stats summarised' failed: %+v", summary)
+		}
+	})
+
+	t.Run("export orders flattened", func(t *testing.T) {
+		csvOut, ndjsonOut := &strings.Builder{}, &strings.Builder{}
+		query := spec.OrderQuery{Status: mock.MockOrders[0].Status}
+
+		count, err := mockOrdersSvc.ExportOrders(csvOut, query, impl.ExportCSV)
+		if err != nil || count != 1 || !strings.HasPrefix(csvOut.String(), "orderId,title,forUser,") ||
+			!strings.Contains(csvOut.String(), "mock@example.net,"+string(query.Status)) || !strings.Contains(csvOut.String(), ",Paisley Cravat Ascot Tie,2,11.20,22.40") {
+			t.Errorf("'export orders flattened' CSV failed: %+v\n%s", err, csvOut)
+		}
+
+		count, err = mockOrdersSvc.ExportOrders(ndjsonOut, query, impl.ExportNDJSON)
+		if err != nil || count != 1 || strings.Count(ndjsonOut.String(), "\n") != 1 || !strings.Contains(ndjsonOut.String(), `"productName":"Paisley Cravat Ascot Tie","count":2,`) {
+			t.Errorf("'export orders flattened' NDJSON failed: %+v\n%s", err, ndjsonOut)
+		}
+	})
+
+	t.Run("webhook signature", func(t *testing.T) {
+		// Known HMAC-SHA256 test vector from RFC 4231
+		sig := impl.Sign([]byte("what do ya want for nothing?"), "Jefe")
+		if sig != "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843" {
+			t.Errorf("'webhook signature' failed: %s", sig)
+		}
+	})
+
 	t.Run("get new order", func(t *testing.T) {
 		newOrder, err := mockOrdersSvc.GetOrder("ord-mock")
 		if err != nil {
@@ -79,19 +344,93 @@ func TestOrders(t *testing.T) {
 		}
 	})
 
+	t.Run("ship order before processing", func(t *testing.T) {
+		_, err := mockOrdersSvc.ShipOrder("ord-mock", spec.Shipment{Carrier: "Royal Mail", TrackingNumber: "RM123", Address: &mockAddress})
+		if _, ok := err.(spec.TransitionError); !ok {
+			t.Errorf("'ship order before processing' failed: %+v", err)
+		}
+	})
+
+	t.Run("ship processing order", func(t *testing.T) {
+		time.Sleep(time.Millisecond * 1500)
+
+		order, err := mockOrdersSvc.ShipOrder("ord-mock", spec.Shipment{Carrier: "Royal Mail", TrackingNumber: "RM123", Address: &mockAddress})
+		if err != nil || order.Status != spec.OrderShipped || order.Shipped == nil || order.TrackingNumber != "RM123" || order.ShippingAddress.Postcode != "EC1 1AA" {
+			t.Errorf("'ship processing order' failed: %+v %+v", err, order)
+		}
+	})
+
 	t.Run("order processing completed", func(t *testing.T) {
-		time.Sleep(time.Second * 3)
+		time.Sleep(time.Millisecond * 1500)
 		newOrder, err := mockOrdersSvc.GetOrder("ord-mock")
 		if err != nil {
 			t.Errorf("'order processing completed' failed: %+v", err)
 		} else {
-			if newOrder.Status != spec.OrderComplete {
+			if newOrder.Status != spec.OrderComplete || newOrder.Delivered == nil {
 				t.Error("'order processing completed' failed")
 			}
 		}
 	})
+
+	t.Run("order history recorded", func(t *testing.T) {
+		order, _ := mockOrdersSvc.GetOrder("ord-mock")
+		if len(order.History) != 5 || order.History[2].From != spec.OrderProcessing || order.History[2].To != spec.OrderShipped ||
+			order.History[4].From != spec.OrderDelivered || order.History[4].To != spec.OrderComplete {
+			t.Errorf("'order history recorded' failed: %+v", order.History)
+		}
+	})
+
+	t.Run("cancel complete order", func(t *testing.T) {
+		_, err := mockOrdersSvc.CancelOrder("ord-mock")
+		if _, ok := err.(spec.TransitionError); !ok {
+			t.Errorf("'cancel complete order' failed: %+v", err)
+		}
+	})
+
+	t.Run("illegal status change", func(t *testing.T) {
+		order, _ := mockOrdersSvc.GetOrder("ord-mock")
+		err := mockOrdersSvc.SetStatus(order, spec.OrderNew)
+		if _, ok := err.(spec.TransitionError); !ok || order.Status != spec.OrderComplete {
+			t.Errorf("'illegal status change' failed: %+v", err)
+		}
+	})
+
+	t.Run("return too many items", func(t *testing.T) {
+		_, err := mockOrdersSvc.CreateReturn("ord-mock", []spec.ReturnItem{{ProductID: "prd3", Count: 3}}, "")
+		if err == nil || !strings.Contains(err.Error(), "too many") {
+			t.Errorf("'return too many items' failed: %+v", err)
+		}
+	})
+
+	t.Run("partial return approved", func(t *testing.T) {
+		ret, err := mockOrdersSvc.CreateReturn("ord-mock", []spec.ReturnItem{{ProductID: "prd3", Count: 1}}, "too loud")
+		if err != nil || ret.RefundAmount != 11.2 {
+			t.Fatalf("'partial return approved' failed: %+v", err)
+		}
+
+		_, err = mockOrdersSvc.ResolveReturn(ret.ID, true)
+		order, _ := mockOrdersSvc.GetOrder("ord-mock")
+		if err != nil || order.Status != spec.OrderPartiallyRefunded {
+			t.Errorf("'partial return approved' failed: %+v", err)
+		}
+	})
+
+	t.Run("full return approved", func(t *testing.T) {
+		ret, err := mockOrdersSvc.CreateReturn("ord-mock", []spec.ReturnItem{{ProductID: "prd3", Count: 1}}, "")
+		if err != nil {
+			t.Fatalf("'full return approved' failed: %+v", err)
+		}
+
+		_, err = mockOrdersSvc.ResolveReturn(ret.ID, true)
+		order, _ := mockOrdersSvc.GetOrder("ord-mock")
+		if err != nil || order.Status != spec.OrderReturned {
+			t.Errorf("'full return approved' failed: %+v", err)
+		}
+	})
 }
 
+var mockAddress = spec.Address{Name: "Mock User", Lines: []string{"1 Mock Street"}, City: "London", Postcode: "EC1 1AA", Country: "UK"}
+
 var testCases = []httptester.TestCase{
 	{
 		Name:           "get an existing order",
@@ -102,6 +441,15 @@ var testCases = []httptester.TestCase{
 		CheckBodyCount: 1,
 		CheckStatus:    200,
 	},
+	{
+		Name:           "get an order with history",
+		URL:            "/get/ord-mock",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      `"history":`,
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
 	{
 		Name:           "get an non-existent order",
 		URL:            "/get/foo",
@@ -111,4 +459,400 @@ var testCases = []httptester.TestCase{
 		CheckBodyCount: 1,
 		CheckStatus:    404,
 	},
+	{
+		Name:           "cancel an order",
+		URL:            "/cancel/ord-mock",
+		Method:         "POST",
+		Body:           "",
+		CheckBody:      `"status":"cancelled"`,
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "cancel a non-existent order",
+		URL:            "/cancel/foo",
+		Method:         "POST",
+		Body:           "",
+		CheckBody:      "not found",
+		CheckBodyCount: 1,
+		CheckStatus:    404,
+	},
+	{
+		Name:           "get invoice for unpaid order",
+		URL:            "/invoice/ord-mock",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      "not been paid",
+		CheckBodyCount: 1,
+		CheckStatus:    409,
+	},
+	{
+		Name:           "get invoice for non-existent order",
+		URL:            "/invoice/foo",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      "not found",
+		CheckBodyCount: 1,
+		CheckStatus:    404,
+	},
+	{
+		Name:           "get stats for range of days",
+		URL:            "/admin/stats?from=2023-01-01&to=2023-01-03",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      `"date":"2023-01-0`,
+		CheckBodyCount: 3,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "get stats for too many days",
+		URL:            "/admin/stats?from=2020-01-01&to=2023-01-01",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      "no more than 366 days",
+		CheckBodyCount: 1,
+		CheckStatus:    400,
+	},
+	{
+		Name:           "get stats with bad date",
+		URL:            "/admin/stats?to=yesterday",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      "invalid to date",
+		CheckBodyCount: 1,
+		CheckStatus:    400,
+	},
+	{
+		Name:           "export orders as csv",
+		URL:            "/admin/export?from=2023-01-01&to=2023-01-31",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      "orderId,title,forUser,status,created,amount,paymentRef,productId,productName,count,unitPrice,lineTotal",
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "export orders without from date",
+		URL:            "/admin/export?format=ndjson",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      "from date is required",
+		CheckBodyCount: 1,
+		CheckStatus:    400,
+	},
+	{
+		Name:           "export orders with bad format",
+		URL:            "/admin/export?from=2023-01-01&format=xml",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      "format must be csv or ndjson",
+		CheckBodyCount: 1,
+		CheckStatus:    400,
+	},
+	{
+		Name:           "ship order without tracking number",
+		URL:            "/admin/ship/ord-mock",
+		Method:         "POST",
+		Body:           `{"carrier": "Royal Mail"}`,
+		CheckBody:      "carrier and trackingNumber are required",
+		CheckBodyCount: 1,
+		CheckStatus:    400,
+	},
+	{
+		Name:           "ship order without address",
+		URL:            "/admin/ship/ord-mock",
+		Method:         "POST",
+		Body:           `{"carrier": "Royal Mail", "trackingNumber": "RM123"}`,
+		CheckBody:      "shipping address",
+		CheckBodyCount: 1,
+		CheckStatus:    400,
+	},
+	{
+		Name:           "ship order not yet processed",
+		URL:            "/admin/ship/ord-mock",
+		Method:         "POST",
+		Body:           `{"carrier": "Royal Mail", "trackingNumber": "RM123", "address": {"name": "Mock User", "lines": ["1 Mock Street"], "postcode": "EC1 1AA"}}`,
+		CheckBody:      "can not change from 'new' to 'shipped'",
+		CheckBodyCount: 1,
+		CheckStatus:    409,
+	},
+	{
+		Name:           "ship non-existent order",
+		URL:            "/admin/ship/foo",
+		Method:         "POST",
+		Body:           `{"carrier": "Royal Mail", "trackingNumber": "RM123"}`,
+		CheckBody:      "not found",
+		CheckBodyCount: 1,
+		CheckStatus:    404,
+	},
+	{
+		Name:           "get held orders",
+		URL:            "/admin/held",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      `\[\]`,
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "review order with bad decision",
+		URL:            "/admin/review/ord-mock/foo",
+		Method:         "PUT",
+		Body:           "",
+		CheckBody:      "decision must be",
+		CheckBodyCount: 1,
+		CheckStatus:    400,
+	},
+	{
+		Name:           "review order not on hold",
+		URL:            "/admin/review/ord-mock/release",
+		Method:         "PUT",
+		Body:           "",
+		CheckBody:      "not on hold",
+		CheckBodyCount: 1,
+		CheckStatus:    409,
+	},
+	{
+		Name:           "review non-existent order",
+		URL:            "/admin/review/foo/reject",
+		Method:         "PUT",
+		Body:           "",
+		CheckBody:      "not found",
+		CheckBodyCount: 1,
+		CheckStatus:    404,
+	},
+	{
+		Name:           "return items on incomplete order",
+		URL:            "/return/ord-mock",
+		Method:         "POST",
+		Body:           `{"items":[{"productId":"prd3","count":1}],"reason":"too small"}`,
+		CheckBody:      "order status invalid",
+		CheckBodyCount: 1,
+		CheckStatus:    409,
+	},
+	{
+		Name:           "return items on non-existent order",
+		URL:            "/return/foo",
+		Method:         "POST",
+		Body:           `{"items":[{"productId":"prd3","count":1}]}`,
+		CheckBody:      "not found",
+		CheckBodyCount: 1,
+		CheckStatus:    404,
+	},
+	{
+		Name:           "get returns for order",
+		URL:            "/returns/ord-mock",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      "\\[\\]",
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "customer can't resolve return",
+		URL:            "/resolveReturn/ord-mock-R1/approve",
+		Method:         "PUT",
+		Body:           "",
+		CheckBody:      "not found",
+		CheckBodyCount: 1,
+		CheckStatus:    404,
+	},
+	{
+		Name:           "resolve non-existent return",
+		URL:            "/admin/resolveReturn/foo-R1/approve",
+		Method:         "PUT",
+		Body:           "",
+		CheckBody:      "return not found",
+		CheckBodyCount: 1,
+		CheckStatus:    404,
+	},
+	{
+		Name:           "resolve return with bad decision",
+		URL:            "/admin/resolveReturn/foo-R1/maybe",
+		Method:         "PUT",
+		Body:           "",
+		CheckBody:      "decision",
+		CheckBodyCount: 1,
+		CheckStatus:    400,
+	},
+	{
+		Name:           "receive order event",
+		URL:            "/dapr/pubsub/receive/test-topic",
+		Method:         "POST",
+		Body:           `{"id":"evt-1","data":{"id":"ord-mock"}}`,
+		CheckBody:      `"status":"SUCCESS"`,
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "receive order event to retry",
+		URL:            "/dapr/pubsub/receive/test-topic",
+		Method:         "POST",
+		Body:           `{"id":"evt-retry","data":{"id":"ord-mock"}}`,
+		CheckBody:      `"status":"RETRY"`,
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "receive poison order event",
+		URL:            "/dapr/pubsub/receive/test-topic",
+		Method:         "POST",
+		Body:           `{"id": "evt-2", "data": {{{{`,
+		CheckBody:      `"status":"DROP"`,
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "get dead letters",
+		URL:            "/admin/deadLetters",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      "evt-mock",
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "replay fixed dead letter",
+		URL:            "/admin/replay/evt-mock",
+		Method:         "POST",
+		Body:           `{"id":"ord-fixed","title":"Fixed order"}`,
+		CheckBody:      "ord-fixed",
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "replay non-existent dead letter",
+		URL:            "/admin/replay/foo",
+		Method:         "POST",
+		Body:           "",
+		CheckBody:      "dead letter not found",
+		CheckBodyCount: 1,
+		CheckStatus:    404,
+	},
+	{
+		Name:           "get order history",
+		URL:            "/getHistory/mock@example.net",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      `"total":1`,
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "get order history filtered by status",
+		URL:            "/getHistory/mock@example.net?status=complete",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      `"orders":\[\],"page":1,"size":10,"total":0`,
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "get order history past last page",
+		URL:            "/getHistory/mock@example.net?page=2&size=1",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      `"orders":\[\],"page":2,"size":1,"total":1`,
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "get order history with bad date",
+		URL:            "/getHistory/mock@example.net?from=yesterday",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      "invalid date",
+		CheckBodyCount: 1,
+		CheckStatus:    400,
+	},
+	{
+		Name:           "get order history with bad page size",
+		URL:            "/getHistory/mock@example.net?size=500",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      "size must be",
+		CheckBodyCount: 1,
+		CheckStatus:    400,
+	},
+	{
+		Name:           "watch an order",
+		URL:            "/watch/ord-mock",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      `event: status\nretry: 2000\ndata: {"id":"ord-mock"`,
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "watch a non-existent order",
+		URL:            "/watch/foo",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      "not found",
+		CheckBodyCount: 1,
+		CheckStatus:    404,
+	},
+	{
+		Name:           "add webhook",
+		URL:            "/admin/webhooks",
+		Method:         "POST",
+		Body:           `{"url":"https://example.net/hook","events":["order.complete"]}`,
+		CheckBody:      `"secret":"mock-secret"`,
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "add webhook with bad event type",
+		URL:            "/admin/webhooks",
+		Method:         "POST",
+		Body:           `{"url":"https://example.net/hook","events":["order.eaten"]}`,
+		CheckBody:      "unknown event type",
+		CheckBodyCount: 1,
+		CheckStatus:    400,
+	},
+	{
+		Name:           "add webhook with bad url",
+		URL:            "/admin/webhooks",
+		Method:         "POST",
+		Body:           `{"url":"example.net/hook"}`,
+		CheckBody:      "must be an absolute",
+		CheckBodyCount: 1,
+		CheckStatus:    400,
+	},
+	{
+		Name:           "list webhooks hides secrets",
+		URL:            "/admin/webhooks",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      "secret",
+		CheckBodyCount: 0,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "get webhook deliveries",
+		URL:            "/admin/webhooks/hook-1/deliveries",
+		Method:         "GET",
+		Body:           "",
+		CheckBody:      "\\[\\]",
+		CheckBodyCount: 1,
+		CheckStatus:    200,
+	},
+	{
+		Name:           "delete webhook",
+		URL:            "/admin/webhooks/hook-1",
+		Method:         "DELETE",
+		Body:           "",
+		CheckBody:      "",
+		CheckBodyCount: 0,
+		CheckStatus:    204,
+	},
+	{
+		Name:           "delete non-existent webhook",
+		URL:            "/admin/webhooks/hook-1",
+		Method:         "DELETE",
+		Body:           "",
+		CheckBody:      "webhook not found",
+		CheckBodyCount: 1,
+		CheckStatus:    404,
+	},
 }
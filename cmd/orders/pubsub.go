@@ -0,0 +1,50 @@
+// ----------------------------------------------------------------------------
+// Copyright (c) Ben Coleman, 2020
+// Licensed under the MIT License.
+//
+// Dapr pub/sub handler for orders, with control over redelivery
+// ----------------------------------------------------------------------------
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/benc-uk/dapr-store/cmd/orders/impl"
+	"github.com/benc-uk/go-rest-api/pkg/dapr/pubsub"
+	"github.com/go-chi/chi/v5"
+)
+
+// Must match the routes that pubsub.Subscribe tells Dapr about
+const topicRouteBase = "/dapr/pubsub/receive/"
+
+// addOrderTopicHandler plugs in a receiver for messages from a Dapr pub/sub topic
+// Unlike pubsub.AddTopicHandler the receiver decides if Dapr should retry or drop the message
+func addOrderTopicHandler(topic string, router chi.Router, receiver func(event *pubsub.CloudEvent) impl.DeliveryStatus) {
+	log.Printf("### ✉️ DAPR: Registered topic message handler: %s", topic)
+
+	router.Post(topicRouteBase+topic, func(resp http.ResponseWriter, req *http.Request) {
+		status := impl.DeliveryDrop
+		event := &pubsub.CloudEvent{}
+
+		// Events that can't be decoded will never succeed, so they are dropped
+		body, err := io.ReadAll(req.Body)
+		if err == nil {
+			err = json.Unmarshal(body, event)
+		}
+
+		if err != nil {
+			log.Printf("### Error! Unable to decode message from pub/sub topic %s: %s", topic, err)
+		} else {
+			log.Printf("### 📩 Received message: %s from pub/sub topic: %s", event.ID, topic)
+
+			status = receiver(event)
+		}
+
+		resp.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(resp).Encode(map[string]impl.DeliveryStatus{"status": status})
+	})
+}
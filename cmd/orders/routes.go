@@ -8,18 +8,57 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/benc-uk/dapr-store/cmd/orders/impl"
+	"github.com/benc-uk/dapr-store/cmd/orders/spec"
 	"github.com/benc-uk/go-rest-api/pkg/auth"
 	"github.com/benc-uk/go-rest-api/pkg/problem"
 	"github.com/go-chi/chi/v5"
 )
 
+// Longest range of days that stats can be fetched for, and the range used when none is given
+const (
+	maxStatsDays     = 366
+	defaultStatsDays = 30
+)
+
+// How long an order can be watched before the stream is ended, and the client has to reconnect
+const watchTimeout = 5 * time.Minute
+
 // All routes we need should be registered here
 func (api API) addRoutes(router chi.Router, v auth.Validator) {
 	router.Get("/get/{id}", v.Protect(api.getOrder))
+	// Unprotected version for internal (service to service) use
+	// This is not exposed through the API gateway to public
+	router.Get("/private/get/{id}", api.getOrder)
 	router.Get("/getForUser/{userid}", v.Protect(api.getOrdersForUser))
+	router.Get("/getHistory/{userid}", v.Protect(api.getOrderHistory))
+	router.Post("/cancel/{id}", v.Protect(api.cancelOrder))
+	router.Get("/invoice/{id}", v.Protect(api.getInvoice))
+	router.Get("/watch/{id}", v.Protect(api.watchOrder))
+	router.Post("/return/{id}", v.Protect(api.createReturn))
+	router.Get("/returns/{id}", v.Protect(api.getReturns))
+	// Admin routes for internal use, these are NOT exposed through the gateway
+	router.Get("/admin/deadLetters", api.getDeadLetters)
+	router.Post("/admin/replay/{id}", api.replayDeadLetter)
+	router.Post("/admin/webhooks", api.addWebhook)
+	router.Get("/admin/webhooks", api.getWebhooks)
+	router.Delete("/admin/webhooks/{id}", api.deleteWebhook)
+	router.Get("/admin/webhooks/{id}/deliveries", api.getWebhookDeliveries)
+	router.Get("/admin/export", api.exportOrders)
+	router.Get("/admin/stats", api.getStats)
+	router.Post("/admin/ship/{id}", api.shipOrder)
+	router.Get("/admin/held", api.getHeldOrders)
+	router.Put("/admin/review/{id}/{decision}", api.reviewOrder)
+	router.Put("/admin/resolveReturn/{returnId}/{decision}", api.resolveReturn)
 }
 
 // Fetch existing order by id
@@ -55,3 +94,569 @@ func (api API) getOrdersForUser(resp http.ResponseWriter, req *http.Request) {
 
 	api.ReturnJSON(resp, orders)
 }
+
+// Fetch full orders for a given user, newest first, with optional filters on status & dates
+// Query params: page, size, status, from & to, dates are RFC3339 or YYYY-MM-DD with 'to' being inclusive
+func (api API) getOrderHistory(resp http.ResponseWriter, req *http.Request) {
+	userID := chi.URLParam(req, "userid")
+	params := req.URL.Query()
+
+	query := spec.OrderQuery{
+		Status: spec.OrderStatus(params.Get("status")),
+		Page:   1,
+		Size:   10,
+	}
+
+	var err error
+
+	if p := params.Get("page"); p != "" {
+		if query.Page, err = strconv.Atoi(p); err != nil || query.Page < 1 {
+			problem.Wrap(400, req.RequestURI, userID, errors.New("page must be a number > 0")).Send(resp)
+			return
+		}
+	}
+
+	if sz := params.Get("size"); sz != "" {
+		if query.Size, err = strconv.Atoi(sz); err != nil || query.Size < 1 || query.Size > 100 {
+			problem.Wrap(400, req.RequestURI, userID, errors.New("size must be a number between 1 and 100")).Send(resp)
+			return
+		}
+	}
+
+	if query.From, err = parseDate(params.Get("from"), false); err != nil {
+		problem.Wrap(400, req.RequestURI, userID, err).Send(resp)
+		return
+	}
+
+	if query.To, err = parseDate(params.Get("to"), true); err != nil {
+		problem.Wrap(400, req.RequestURI, userID, err).Send(resp)
+		return
+	}
+
+	page, err := api.service.GetOrderHistory(userID, query)
+	if err != nil {
+		problem.Wrap(500, req.RequestURI, userID, err).Send(resp)
+
+		return
+	}
+
+	api.ReturnJSON(resp, page)
+}
+
+// Parse a RFC3339 timestamp or plain date, a plain date at the end of a range covers the whole day
+func parseDate(value string, endOfRange bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date '%s', use RFC3339 or YYYY-MM-DD", value)
+	}
+
+	if endOfRange {
+		t = t.AddDate(0, 0, 1)
+	}
+
+	return t, nil
+}
+
+// Sales stats summarised over a range of days, from & to are dates and both are included
+// With no range the last defaultStatsDays days are used, up to & including today
+func (api API) getStats(resp http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	to := time.Now().UTC().Truncate(24 * time.Hour)
+	from := to.AddDate(0, 0, 1-defaultStatsDays)
+
+	var err error
+
+	if t := params.Get("to"); t != "" {
+		if to, err = time.Parse("2006-01-02", t); err != nil {
+			problem.Wrap(400, req.RequestURI, "stats", fmt.Errorf("invalid to date '%s', use YYYY-MM-DD", t)).Send(resp)
+			return
+		}
+
+		from = to.AddDate(0, 0, 1-defaultStatsDays)
+	}
+
+	if f := params.Get("from"); f != "" {
+		if from, err = time.Parse("2006-01-02", f); err != nil {
+			problem.Wrap(400, req.RequestURI, "stats", fmt.Errorf("invalid from date '%s', use YYYY-MM-DD", f)).Send(resp)
+			return
+		}
+	}
+
+	if to.Before(from) || to.Sub(from) >= maxStatsDays*24*time.Hour {
+		problem.Wrap(400, req.RequestURI, "stats", fmt.Errorf("from must be before to, and the range no more than %d days", maxStatsDays)).Send(resp)
+		return
+	}
+
+	summary, err := api.service.GetStats(from, to)
+	if err != nil {
+		problem.Wrap(500, req.RequestURI, "stats", err).Send(resp)
+
+		return
+	}
+
+	api.ReturnJSON(resp, summary)
+}
+
+// Stream changes to an order as server-sent events, starting with the order as it is now
+// The stream ends when the order reaches a final status, or after watchTimeout when clients should reconnect
+func (api API) watchOrder(resp http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+
+	order, err := api.service.GetOrder(id)
+	if err != nil {
+		if orderError, ok := err.(impl.OrdersError); ok && orderError.Error() == impl.NotFoundError {
+			problem.Wrap(404, req.RequestURI, id, err).Send(resp)
+
+			return
+		}
+
+		problem.Wrap(500, req.RequestURI, id, err).Send(resp)
+
+		return
+	}
+
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		problem.Wrap(500, req.RequestURI, id, errors.New("streaming not supported")).Send(resp)
+		return
+	}
+
+	// Subscribe before sending the current order, so no changes can slip through the gap
+	updates, stop := api.service.WatchOrder(id)
+	defer stop()
+
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.Header().Set("Connection", "keep-alive")
+	resp.WriteHeader(200)
+
+	timeout := time.NewTimer(watchTimeout)
+	defer timeout.Stop()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	sent := 0
+
+	for {
+		if order != nil {
+			if err := writeOrderEvent(resp, order); err != nil {
+				return
+			}
+
+			sent = len(order.History)
+
+			flusher.Flush()
+
+			if spec.IsFinal(order.Status) {
+				return
+			}
+
+			order = nil
+		}
+
+		select {
+		case update, open := <-updates:
+			if !open {
+				return
+			}
+
+			// The same change can arrive more than once, only those newer than the last sent are passed on
+			if len(update.History) > sent {
+				order = &update
+			}
+		case <-keepAlive.C:
+			_, _ = resp.Write([]byte(": keep-alive\n\n"))
+			flusher.Flush()
+		case <-timeout.C:
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// Write an order as a server-sent event, the retry field tells the browser how soon to reconnect
+func writeOrderEvent(resp http.ResponseWriter, order *spec.Order) error {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(resp, "event: status\nretry: 2000\ndata: %s\n\n", data)
+
+	return err
+}
+
+// Cancel an order, only possible before it is complete
+func (api API) cancelOrder(resp http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+
+	order, err := api.service.CancelOrder(id)
+	if err != nil {
+		if orderError, ok := err.(impl.OrdersError); ok && orderError.Error() == impl.NotFoundError {
+			problem.Wrap(404, req.RequestURI, id, err).Send(resp)
+
+			return
+		}
+
+		if _, ok := err.(spec.TransitionError); ok {
+			problem.Wrap(409, req.RequestURI, id, err).Send(resp)
+
+			return
+		}
+
+		if orderError, ok := err.(impl.OrdersError); ok && orderError.Error() == impl.ChangedError {
+			problem.Wrap(409, req.RequestURI, id, err).Send(resp)
+
+			return
+		}
+
+		problem.Wrap(500, req.RequestURI, id, err).Send(resp)
+
+		return
+	}
+
+	api.ReturnJSON(resp, order)
+}
+
+// Warehouse staff mark an order as shipped, with the carrier & tracking number in the body
+func (api API) shipOrder(resp http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	shipment := spec.Shipment{}
+
+	if err := json.NewDecoder(req.Body).Decode(&shipment); err != nil {
+		problem.Wrap(400, req.RequestURI, id, err).Send(resp)
+		return
+	}
+
+	order, err := api.service.ShipOrder(id, shipment)
+	if err != nil {
+		if orderError, ok := err.(impl.OrdersError); ok && orderError.Error() == impl.NotFoundError {
+			problem.Wrap(404, req.RequestURI, id, err).Send(resp)
+
+			return
+		}
+
+		if orderError, ok := err.(impl.OrdersError); ok && strings.HasPrefix(orderError.Error(), impl.ShipmentInvalidPrefix) {
+			problem.Wrap(400, req.RequestURI, id, err).Send(resp)
+
+			return
+		}
+
+		if _, ok := err.(spec.TransitionError); ok {
+			problem.Wrap(409, req.RequestURI, id, err).Send(resp)
+
+			return
+		}
+
+		if orderError, ok := err.(impl.OrdersError); ok && orderError.Error() == impl.ChangedError {
+			problem.Wrap(409, req.RequestURI, id, err).Send(resp)
+
+			return
+		}
+
+		problem.Wrap(500, req.RequestURI, id, err).Send(resp)
+
+		return
+	}
+
+	api.ReturnJSON(resp, order)
+}
+
+// Invoice is HTML by default, use ?format=pdf or an Accept header of application/pdf for a PDF
+func (api API) getInvoice(resp http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+
+	invoice, err := api.service.GetInvoice(id)
+	if err != nil {
+		if orderError, ok := err.(impl.OrdersError); ok && orderError.Error() == impl.NotFoundError {
+			problem.Wrap(404, req.RequestURI, id, err).Send(resp)
+
+			return
+		}
+
+		if orderError, ok := err.(impl.OrdersError); ok && orderError.Error() == impl.InvoiceUnpaidError {
+			problem.Wrap(409, req.RequestURI, id, err).Send(resp)
+
+			return
+		}
+
+		problem.Wrap(500, req.RequestURI, id, err).Send(resp)
+
+		return
+	}
+
+	format := req.URL.Query().Get("format")
+	if format == "" && strings.Contains(req.Header.Get("Accept"), "application/pdf") {
+		format = "pdf"
+	}
+
+	switch format {
+	case "", "html":
+		html, err := impl.RenderInvoiceHTML(*invoice)
+		if err != nil {
+			problem.Wrap(500, req.RequestURI, id, err).Send(resp)
+
+			return
+		}
+
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = resp.Write(html)
+	case "pdf":
+		resp.Header().Set("Content-Type", "application/pdf")
+		resp.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s.pdf"`, invoice.Number))
+		_, _ = resp.Write(impl.RenderInvoicePDF(*invoice))
+	default:
+		problem.Wrap(400, req.RequestURI, id, fmt.Errorf("format '%s' is not supported, use html or pdf", format)).Send(resp)
+	}
+}
+
+// Request a return of items on a completed order
+func (api API) createReturn(resp http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+
+	returnReq := struct {
+		Items  []spec.ReturnItem `json:"items"`
+		Reason string            `json:"reason"`
+	}{}
+
+	if err := json.NewDecoder(req.Body).Decode(&returnReq); err != nil {
+		problem.Wrap(400, req.RequestURI, id, err).Send(resp)
+		return
+	}
+
+	ret, err := api.service.CreateReturn(id, returnReq.Items, returnReq.Reason)
+	if err != nil {
+		api.sendReturnProblem(resp, req, id, err)
+		return
+	}
+
+	api.ReturnJSON(resp, ret)
+}
+
+// Fetch all returns for an order
+func (api API) getReturns(resp http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+
+	returns, err := api.service.GetReturns(id)
+	if err != nil {
+		problem.Wrap(500, req.RequestURI, id, err).Send(resp)
+
+		return
+	}
+
+	api.ReturnJSON(resp, returns)
+}
+
+// Approve or reject a return
+func (api API) resolveReturn(resp http.ResponseWriter, req *http.Request) {
+	returnID := chi.URLParam(req, "returnId")
+	decision := chi.URLParam(req, "decision")
+
+	if decision != "approve" && decision != "reject" {
+		problem.Wrap(400, req.RequestURI, returnID, errors.New("decision must be 'approve' or 'reject'")).Send(resp)
+		return
+	}
+
+	ret, err := api.service.ResolveReturn(returnID, decision == "approve")
+	if err != nil {
+		api.sendReturnProblem(resp, req, returnID, err)
+		return
+	}
+
+	api.ReturnJSON(resp, ret)
+}
+
+// Map errors from the returns part of the OrderService to problem responses
+func (api API) sendReturnProblem(resp http.ResponseWriter, req *http.Request, id string, err error) {
+	status := 500
+
+	if orderError, ok := err.(impl.OrdersError); ok {
+		switch {
+		case orderError.Error() == impl.NotFoundError || orderError.Error() == impl.ReturnMissingError:
+			status = 404
+		case orderError.Error() == impl.StatusError || orderError.Error() == impl.ReturnResolvedError ||
+			orderError.Error() == impl.ChangedError:
+			status = 409
+		case strings.HasPrefix(orderError.Error(), impl.ReturnInvalidPrefix):
+			status = 400
+		}
+	}
+
+	if _, ok := err.(spec.TransitionError); ok {
+		status = 409
+	}
+
+	problem.Wrap(status, req.RequestURI, id, err).Send(resp)
+}
+
+// Fetch all order events that failed and were dead-lettered
+func (api API) getDeadLetters(resp http.ResponseWriter, req *http.Request) {
+	letters, err := api.service.GetDeadLetters()
+	if err != nil {
+		problem.Wrap(500, req.RequestURI, "deadLetters", err).Send(resp)
+
+		return
+	}
+
+	api.ReturnJSON(resp, letters)
+}
+
+// Replay a dead-lettered order, optionally with a fixed version of the order in the body
+func (api API) replayDeadLetter(resp http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		problem.Wrap(400, req.RequestURI, id, err).Send(resp)
+		return
+	}
+
+	var fixed *spec.Order
+
+	if len(body) > 0 {
+		fixed = &spec.Order{}
+		if err := json.Unmarshal(body, fixed); err != nil {
+			problem.Wrap(400, req.RequestURI, id, err).Send(resp)
+			return
+		}
+	}
+
+	order, err := api.service.ReplayDeadLetter(id, fixed)
+	if err != nil {
+		if orderError, ok := err.(impl.OrdersError); ok && orderError.Error() == impl.DeadLetterMissingError {
+			problem.Wrap(404, req.RequestURI, id, err).Send(resp)
+
+			return
+		}
+
+		problem.Wrap(500, req.RequestURI, id, err).Send(resp)
+
+		return
+	}
+
+	api.ReturnJSON(resp, order)
+}
+
+// Fetch all orders put on hold by fraud screening, waiting for review
+func (api API) getHeldOrders(resp http.ResponseWriter, req *http.Request) {
+	orders, err := api.service.GetHeldOrders()
+	if err != nil {
+		problem.Wrap(500, req.RequestURI, "held", err).Send(resp)
+
+		return
+	}
+
+	api.ReturnJSON(resp, orders)
+}
+
+// Release or reject an order on hold, the decision must be 'release' or 'reject'
+func (api API) reviewOrder(resp http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	decision := chi.URLParam(req, "decision")
+
+	if decision != "release" && decision != "reject" {
+		problem.Wrap(400, req.RequestURI, id, errors.New("decision must be 'release' or 'reject'")).Send(resp)
+		return
+	}
+
+	order, err := api.service.ReviewOrder(id, decision == "release")
+	if err != nil {
+		if orderError, ok := err.(impl.OrdersError); ok && orderError.Error() == impl.NotFoundError {
+			problem.Wrap(404, req.RequestURI, id, err).Send(resp)
+
+			return
+		}
+
+		if orderError, ok := err.(impl.OrdersError); ok && (orderError.Error() == impl.NotHeldError || orderError.Error() == impl.ChangedError) {
+			problem.Wrap(409, req.RequestURI, id, err).Send(resp)
+
+			return
+		}
+
+		problem.Wrap(500, req.RequestURI, id, err).Send(resp)
+
+		return
+	}
+
+	api.ReturnJSON(resp, order)
+}
+
+// Register a new webhook, the response is the only time the secret is returned
+func (api API) addWebhook(resp http.ResponseWriter, req *http.Request) {
+	hook := spec.Webhook{}
+
+	if err := json.NewDecoder(req.Body).Decode(&hook); err != nil {
+		problem.Wrap(400, req.RequestURI, "new-webhook", err).Send(resp)
+		return
+	}
+
+	added, err := api.service.AddWebhook(hook)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), impl.WebhookInvalidPrefix) {
+			problem.Wrap(400, req.RequestURI, "new-webhook", err).Send(resp)
+			return
+		}
+
+		problem.Wrap(500, req.RequestURI, "new-webhook", err).Send(resp)
+
+		return
+	}
+
+	api.ReturnJSON(resp, added)
+}
+
+// Fetch all webhooks
+func (api API) getWebhooks(resp http.ResponseWriter, req *http.Request) {
+	hooks, err := api.service.GetWebhooks()
+	if err != nil {
+		problem.Wrap(500, req.RequestURI, "webhooks", err).Send(resp)
+
+		return
+	}
+
+	api.ReturnJSON(resp, hooks)
+}
+
+// Remove a webhook
+func (api API) deleteWebhook(resp http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+
+	if err := api.service.DeleteWebhook(id); err != nil {
+		sendWebhookProblem(resp, req, id, err)
+		return
+	}
+
+	resp.WriteHeader(204)
+}
+
+// Fetch the log of recent deliveries to a webhook
+func (api API) getWebhookDeliveries(resp http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+
+	deliveries, err := api.service.GetWebhookDeliveries(id)
+	if err != nil {
+		sendWebhookProblem(resp, req, id, err)
+		return
+	}
+
+	api.ReturnJSON(resp, deliveries)
+}
+
+func sendWebhookProblem(resp http.ResponseWriter, req *http.Request, id string, err error) {
+	if orderError, ok := err.(impl.OrdersError); ok && orderError.Error() == impl.WebhookMissingError {
+		problem.Wrap(404, req.RequestURI, id, err).Send(resp)
+		return
+	}
+
+	problem.Wrap(500, req.RequestURI, id, err).Send(resp)
+}
@@ -0,0 +1,53 @@
+package spec
+
+import (
+	"time"
+)
+
+// ExportRow is a single line item of an order, flattened along with the order details for exporting
+// Orders without any line items are exported as one row with the product fields left empty
+type ExportRow struct {
+	OrderID     string      `json:"orderId"`
+	Title       string      `json:"title"`
+	ForUserID   string      `json:"forUser"`
+	Status      OrderStatus `json:"status"`
+	Created     time.Time   `json:"created"`
+	Amount      float32     `json:"amount"`
+	PaymentRef  string      `json:"paymentRef"`
+	ProductID   string      `json:"productId"`
+	ProductName string      `json:"productName"`
+	Count       int         `json:"count"`
+	UnitPrice   float32     `json:"unitPrice"`
+	LineTotal   float32     `json:"lineTotal"`
+}
+
+// ExportRows flattens an order into rows, one per line item
+func ExportRows(order Order) []ExportRow {
+	base := ExportRow{
+		OrderID:    order.ID,
+		Title:      order.Title,
+		ForUserID:  order.ForUserID,
+		Status:     order.Status,
+		Created:    order.Created,
+		Amount:     order.Amount,
+		PaymentRef: order.PaymentRef,
+	}
+
+	if len(order.LineItems) == 0 {
+		return []ExportRow{base}
+	}
+
+	rows := []ExportRow{}
+
+	for _, line := range order.LineItems {
+		row := base
+		row.ProductID = line.Product.ID
+		row.ProductName = line.Product.Name
+		row.Count = line.Count
+		row.UnitPrice = line.Product.Cost
+		row.LineTotal = float32(round2(float64(line.Product.Cost) * float64(line.Count)))
+		rows = append(rows, row)
+	}
+
+	return rows
+}
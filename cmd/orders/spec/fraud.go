@@ -0,0 +1,35 @@
+package spec
+
+import (
+	"fmt"
+)
+
+// FraudRules are the limits orders are screened against before they are accepted
+// Orders breaking any rule are put on hold for manual review, a limit of zero turns the rule off
+type FraudRules struct {
+	MaxAmount        float32 // Orders for more than this amount
+	MaxOrdersPerHour int     // Users placing more than this many orders in an hour
+	MaxQuantity      int     // Line items with more than this many of a product
+}
+
+// Screen checks an order against the rules, giving the reasons it should be held, if any
+// recentOrders is how many other orders the user placed in the hour before this one
+func (r FraudRules) Screen(order Order, recentOrders int) []string {
+	reasons := []string{}
+
+	if r.MaxAmount > 0 && order.Amount > r.MaxAmount {
+		reasons = append(reasons, fmt.Sprintf("amount %.2f is over the limit of %.2f", order.Amount, r.MaxAmount))
+	}
+
+	if r.MaxOrdersPerHour > 0 && recentOrders >= r.MaxOrdersPerHour {
+		reasons = append(reasons, fmt.Sprintf("user placed %d other orders in the last hour, the limit is %d", recentOrders, r.MaxOrdersPerHour))
+	}
+
+	for _, line := range order.LineItems {
+		if r.MaxQuantity > 0 && line.Count > r.MaxQuantity {
+			reasons = append(reasons, fmt.Sprintf("quantity %d of product %s is over the limit of %d", line.Count, line.Product.ID, r.MaxQuantity))
+		}
+	}
+
+	return reasons
+}
@@ -0,0 +1,76 @@
+package spec
+
+import (
+	"sort"
+	"time"
+)
+
+// OrderQuery filters and pages through a list of orders
+type OrderQuery struct {
+	Status OrderStatus // Only orders with this status, blank for all
+	From   time.Time   // Only orders created at or after this time, zero for no limit
+	To     time.Time   // Only orders created before this time, zero for no limit
+	Page   int         // Page number, starting at 1
+	Size   int         // Number of orders per page
+}
+
+// OrderPage is a single page of orders from an OrderQuery
+type OrderPage struct {
+	Orders []Order `json:"orders"`
+	Page   int     `json:"page"`
+	Size   int     `json:"size"`
+	Total  int     `json:"total"` // Count of all orders matching the query, across all pages
+}
+
+// Matches checks if an order passes the status & date filters of the query
+func (query OrderQuery) Matches(o Order) bool {
+	if query.Status != "" && o.Status != query.Status {
+		return false
+	}
+
+	if !query.From.IsZero() && o.Created.Before(query.From) {
+		return false
+	}
+
+	if !query.To.IsZero() && !o.Created.Before(query.To) {
+		return false
+	}
+
+	return true
+}
+
+// QueryOrders filters orders, sorts them newest first and returns the requested page
+func QueryOrders(orders []Order, query OrderQuery) *OrderPage {
+	matching := []Order{}
+
+	for _, o := range orders {
+		if query.Matches(o) {
+			matching = append(matching, o)
+		}
+	}
+
+	sort.SliceStable(matching, func(i, j int) bool {
+		return matching[i].Created.After(matching[j].Created)
+	})
+
+	page := &OrderPage{
+		Orders: []Order{},
+		Page:   query.Page,
+		Size:   query.Size,
+		Total:  len(matching),
+	}
+
+	start := (query.Page - 1) * query.Size
+	if query.Page < 1 || query.Size < 1 || start >= len(matching) {
+		return page
+	}
+
+	end := start + query.Size
+	if end > len(matching) {
+		end = len(matching)
+	}
+
+	page.Orders = matching[start:end]
+
+	return page
+}
@@ -0,0 +1,156 @@
+package spec
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Invoice is issued once for an order, after which it never changes
+type Invoice struct {
+	Number     string        `json:"number"`
+	OrderID    string        `json:"orderId"`
+	Issued     time.Time     `json:"issued"`
+	Seller     Seller        `json:"seller"`
+	Customer   Customer      `json:"customer"`
+	Lines      []InvoiceLine `json:"lines"`
+	Taxes      []TaxLine     `json:"taxes"` // Breakdown of tax, one line per tax rate
+	Net        float32       `json:"net"`
+	Tax        float32       `json:"tax"`
+	Total      float32       `json:"total"`
+	Currency   string        `json:"currency"`
+	PaymentRef string        `json:"paymentRef,omitempty"`
+}
+
+// Seller is the business issuing invoices
+type Seller struct {
+	Name    string   `json:"name"`
+	Address []string `json:"address"`
+	Email   string   `json:"email,omitempty"`
+	TaxID   string   `json:"taxId,omitempty"`
+}
+
+// Customer is who an invoice is addressed to
+type Customer struct {
+	UserID string `json:"userId"`
+	Name   string `json:"name,omitempty"`
+	Email  string `json:"email,omitempty"`
+}
+
+// InvoiceLine is a line item on an invoice, prices include tax so the gross is what the customer paid
+type InvoiceLine struct {
+	ProductID string  `json:"productId"`
+	Name      string  `json:"name"`
+	Count     int     `json:"count"`
+	UnitPrice float32 `json:"unitPrice"`
+	TaxRate   float32 `json:"taxRate"` // As a percentage
+	Net       float32 `json:"net"`
+	Tax       float32 `json:"tax"`
+	Gross     float32 `json:"gross"`
+}
+
+// TaxLine is the total net amount and tax charged at a single tax rate
+type TaxLine struct {
+	Rate float32 `json:"rate"`
+	Net  float32 `json:"net"`
+	Tax  float32 `json:"tax"`
+}
+
+// NewInvoice creates an invoice for an order, splitting the tax out of each line at the given rate
+func NewInvoice(number string, order Order, seller Seller, customer Customer, taxRate float32, currency string, issued time.Time) Invoice {
+	inv := Invoice{
+		Number:     number,
+		OrderID:    order.ID,
+		Issued:     issued,
+		Seller:     seller,
+		Customer:   customer,
+		Lines:      []InvoiceLine{},
+		Taxes:      []TaxLine{},
+		Currency:   currency,
+		PaymentRef: order.PaymentRef,
+	}
+
+	taxes := map[float32]*TaxLine{}
+
+	for _, item := range order.LineItems {
+		gross := item.Total()
+		net, tax := SplitTax(gross, taxRate)
+
+		line := InvoiceLine{
+			ProductID: item.Product.ID,
+			Name:      item.Product.Name,
+			Count:     item.Count,
+			UnitPrice: item.Product.Cost,
+			TaxRate:   taxRate,
+			Net:       net,
+			Tax:       tax,
+			Gross:     gross,
+		}
+		inv.Lines = append(inv.Lines, line)
+
+		if taxes[line.TaxRate] == nil {
+			taxes[line.TaxRate] = &TaxLine{Rate: line.TaxRate}
+		}
+
+		taxes[line.TaxRate].Net += line.Net
+		taxes[line.TaxRate].Tax += line.Tax
+		inv.Net += line.Net
+		inv.Tax += line.Tax
+		inv.Total += line.Gross
+	}
+
+	// Summing float32 can leave stray fractions of a penny
+	for _, t := range taxes {
+		inv.Taxes = append(inv.Taxes, TaxLine{t.Rate, float32(round2(float64(t.Net))), float32(round2(float64(t.Tax)))})
+	}
+
+	inv.Net = float32(round2(float64(inv.Net)))
+	inv.Tax = float32(round2(float64(inv.Tax)))
+	inv.Total = float32(round2(float64(inv.Total)))
+
+	sort.Slice(inv.Taxes, func(i, j int) bool {
+		return inv.Taxes[i].Rate < inv.Taxes[j].Rate
+	})
+
+	return inv
+}
+
+// Invoiceable checks if an order can have an invoice, which needs it to have been paid for
+func (o Order) Invoiceable() bool {
+	return o.Paid()
+}
+
+// Paid checks if payment was taken for an order, orders held for review and never released have not been paid
+// Orders from before payment refs were stored are paid if they ever got as far as being received
+func (o Order) Paid() bool {
+	if o.PaymentRef != "" {
+		return true
+	}
+
+	for _, change := range o.History {
+		if change.To == OrderReceived {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Total is the cost of a line item including tax, rounded to pennies
+func (l LineItem) Total() float32 {
+	return float32(round2(float64(l.Product.Cost) * float64(l.Count)))
+}
+
+// SplitTax breaks an amount including tax down into the net amount and the tax, both rounded to pennies
+func SplitTax(gross float32, taxRate float32) (float32, float32) {
+	// Rounding first removes any float32 noise, so the split is the same as working in float64 throughout
+	g := round2(float64(gross))
+	net := round2(g / (1 + float64(taxRate)/100))
+
+	return float32(net), float32(round2(g - net))
+}
+
+// Round money to whole pennies/cents
+func round2(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,108 @@
+package spec
+
+import (
+	"fmt"
+	"time"
+)
+
+// Return is a request to send back some or all of the items on a completed order
+type Return struct {
+	ID           string       `json:"id"`
+	OrderID      string       `json:"orderId"` // Ref to Order.ID
+	Items        []ReturnItem `json:"items"`
+	Reason       string       `json:"reason"`
+	Status       ReturnStatus `json:"status"`
+	RefundAmount float32      `json:"refundAmount"`
+	RefundRef    string       `json:"refundRef,omitempty"` // Ref from the PaymentProvider, once an approved return is refunded
+	Created      time.Time    `json:"created"`
+	Resolved     *time.Time   `json:"resolved,omitempty"`
+	// Version of the return in the state store, so it can only be resolved once
+	ETag string `json:"-"`
+}
+
+// ReturnItem is a count of a product being returned, it refers to a LineItem on the order
+type ReturnItem struct {
+	ProductID string `json:"productId"`
+	Count     int    `json:"count"`
+}
+
+// ReturnStatus enum
+type ReturnStatus string
+
+// This is a (sort of) enum of Return statuses
+const (
+	ReturnRequested ReturnStatus = "requested"
+	ReturnApproved  ReturnStatus = "approved"
+	ReturnRejected  ReturnStatus = "rejected"
+)
+
+// ReturnedCounts totals the products on returns that are approved or still awaiting a decision, keyed on product ID
+func ReturnedCounts(returns []Return) map[string]int {
+	counts := map[string]int{}
+
+	for _, r := range returns {
+		if r.Status == ReturnRejected {
+			continue
+		}
+
+		for _, item := range r.Items {
+			counts[item.ProductID] += item.Count
+		}
+	}
+
+	return counts
+}
+
+// Refund checks items can be returned against an order, taking into account counts already returned
+// and calculates the amount to refund for them
+func Refund(order Order, items []ReturnItem, returned map[string]int) (float32, error) {
+	if len(items) == 0 {
+		return 0, fmt.Errorf("no items to return")
+	}
+
+	var amount float32
+
+	requested := map[string]int{}
+
+	for _, item := range items {
+		if item.Count <= 0 {
+			return 0, fmt.Errorf("count for product '%s' must be > 0", item.ProductID)
+		}
+
+		line := order.lineItem(item.ProductID)
+		if line == nil {
+			return 0, fmt.Errorf("product '%s' is not on the order", item.ProductID)
+		}
+
+		requested[item.ProductID] += item.Count
+		if returned[item.ProductID]+requested[item.ProductID] > line.Count {
+			return 0, fmt.Errorf("too many of product '%s', only %d were ordered", item.ProductID, line.Count)
+		}
+
+		amount += line.Product.Cost * float32(item.Count)
+	}
+
+	return amount, nil
+}
+
+// FullyReturned checks if every item on the order has been returned
+func FullyReturned(order Order, returned map[string]int) bool {
+	for _, line := range order.LineItems {
+		if returned[line.Product.ID] < line.Count {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Find the line item for a product on the order, nil if there isn't one
+func (o Order) lineItem(productID string) *LineItem {
+	for i := range o.LineItems {
+		if o.LineItems[i].Product.ID == productID {
+			return &o.LineItems[i]
+		}
+	}
+
+	return nil
+}
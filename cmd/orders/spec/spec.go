@@ -1,19 +1,56 @@
 package spec
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"time"
 
 	productspec "github.com/benc-uk/dapr-store/cmd/products/spec"
 )
 
 // Order holds information about a customer order
 type Order struct {
-	ID        string      `json:"id"`
-	Title     string      `json:"title"`
-	Amount    float32     `json:"amount"`
-	LineItems []LineItem  `json:"lineItems"`
-	Status    OrderStatus `json:"status"`
-	ForUserID string      `json:"forUser"` // Ref to User.UserID
+	ID         string         `json:"id"`
+	Title      string         `json:"title"`
+	Amount     float32        `json:"amount"`
+	LineItems  []LineItem     `json:"lineItems"`
+	Status     OrderStatus    `json:"status"`
+	ForUserID  string         `json:"forUser"` // Ref to User.UserID
+	History    []StatusChange `json:"history"`
+	PaymentRef string         `json:"paymentRef,omitempty"` // Ref from the PaymentProvider
+	RefundRef  string         `json:"refundRef,omitempty"`  // Ref from the PaymentProvider, when a paid order is cancelled
+	Created    time.Time      `json:"created"`
+	// Set while payment is being taken, so only one replica ever charges the order
+	PaymentStarted *time.Time `json:"paymentStarted,omitempty"`
+	// Delivery details, the carrier, tracking & timestamps are set as the order is shipped and delivered
+	ShippingAddress *Address   `json:"shippingAddress,omitempty"`
+	Carrier         string     `json:"carrier,omitempty"`
+	TrackingNumber  string     `json:"trackingNumber,omitempty"`
+	Shipped         *time.Time `json:"shipped,omitempty"`
+	Delivered       *time.Time `json:"delivered,omitempty"`
+	// Why the order was put on hold by fraud screening
+	HoldReasons []string `json:"holdReasons,omitempty"`
+	// Version of the order in the state store, used to detect changes made in the meantime
+	ETag string `json:"-"`
+}
+
+// Address is a postal address for delivering an order
+type Address struct {
+	Name     string   `json:"name"`
+	Lines    []string `json:"lines"`
+	City     string   `json:"city"`
+	Postcode string   `json:"postcode"`
+	Country  string   `json:"country"`
+}
+
+// Shipment is what the warehouse supply when an order is shipped
+// The address is only needed when the order doesn't have one already
+type Shipment struct {
+	Carrier        string   `json:"carrier"`
+	TrackingNumber string   `json:"trackingNumber"`
+	Address        *Address `json:"address,omitempty"`
 }
 
 // LineItem is a simple line on an order, a tuple of count and a Product struct
@@ -27,27 +64,164 @@ type OrderStatus string
 
 // This is a (sort of) enum of Order statuses
 const (
-	OrderNew        OrderStatus = "new"
-	OrderReceived   OrderStatus = "received"
-	OrderProcessing OrderStatus = "processing"
-	OrderComplete   OrderStatus = "complete"
+	OrderNew           OrderStatus = "new"
+	OrderReceived      OrderStatus = "received"
+	OrderProcessing    OrderStatus = "processing"
+	OrderShipped       OrderStatus = "shipped"
+	OrderDelivered     OrderStatus = "delivered"
+	OrderComplete      OrderStatus = "complete"
+	OrderCancelled     OrderStatus = "cancelled"
+	OrderPaymentFailed OrderStatus = "payment_failed"
+	OrderOnHold        OrderStatus = "on_hold" // Held by fraud screening, waiting for review
+	// Statuses for orders with returned items
+	OrderReturned          OrderStatus = "returned"
+	OrderPartiallyRefunded OrderStatus = "partially_refunded"
 )
 
+// StatusChange is an entry in the history of an order, recording a single change of status
+type StatusChange struct {
+	From OrderStatus `json:"from"`
+	To   OrderStatus `json:"to"`
+	At   time.Time   `json:"at"`
+}
+
+// The order state machine, maps each status to the statuses it is allowed to move to
+var transitions = map[OrderStatus][]OrderStatus{
+	OrderNew:           {OrderReceived, OrderPaymentFailed, OrderCancelled, OrderOnHold},
+	OrderOnHold:        {OrderReceived, OrderPaymentFailed, OrderCancelled},
+	OrderReceived:      {OrderProcessing, OrderCancelled},
+	OrderProcessing:    {OrderShipped, OrderCancelled},
+	OrderShipped:       {OrderDelivered},
+	OrderDelivered:     {OrderComplete},
+	OrderComplete:      {OrderReturned, OrderPartiallyRefunded},
+	OrderCancelled:     {},
+	OrderPaymentFailed: {},
+	// Further returns can be made until everything has been sent back
+	OrderPartiallyRefunded: {OrderPartiallyRefunded, OrderReturned},
+	OrderReturned:          {},
+}
+
+// IsFinal checks if an order status is the end of the line, with no further changes possible
+func IsFinal(status OrderStatus) bool {
+	return len(transitions[status]) == 0
+}
+
+// TransitionError is returned when an order is asked to make a status change that is not allowed
+type TransitionError struct {
+	From OrderStatus
+	To   OrderStatus
+}
+
+func (e TransitionError) Error() string {
+	return fmt.Sprintf("order status can not change from '%s' to '%s'", e.From, e.To)
+}
+
+// CanTransition checks if the state machine allows moving from one status to another
+func CanTransition(from OrderStatus, to OrderStatus) bool {
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Transition moves the order to a new status, recording the change in the order history
+// Illegal changes are rejected with a TransitionError, leaving the order untouched
+func (o *Order) Transition(status OrderStatus) error {
+	if !CanTransition(o.Status, status) {
+		return TransitionError{o.Status, status}
+	}
+
+	now := time.Now().UTC()
+
+	o.History = append(o.History, StatusChange{
+		From: o.Status,
+		To:   status,
+		At:   now,
+	})
+	o.Status = status
+
+	switch status {
+	case OrderShipped:
+		o.Shipped = &now
+	case OrderDelivered:
+		o.Delivered = &now
+	}
+
+	return nil
+}
+
 // OrderService defines core CRUD methods a orders service should have
 type OrderService interface {
 	GetOrder(orderID string) (*Order, error)
 	GetOrdersForUser(userID string) ([]string, error)
+	GetOrderHistory(userID string, query OrderQuery) (*OrderPage, error)
 	ProcessOrder(order Order) error
 	AddOrder(Order) error
 	SetStatus(order *Order, status OrderStatus) error
+	CancelOrder(orderID string) (*Order, error)
+	ShipOrder(orderID string, shipment Shipment) (*Order, error)
+	GetHeldOrders() ([]Order, error)
+	ReviewOrder(orderID string, release bool) (*Order, error)
+	GetInvoice(orderID string) (*Invoice, error)
+	GetStats(from time.Time, to time.Time) (*SalesSummary, error)
+	ExportOrders(w io.Writer, query OrderQuery, format string) (int, error)
+	WatchOrder(orderID string) (<-chan Order, func())
+	CreateReturn(orderID string, items []ReturnItem, reason string) (*Return, error)
+	GetReturns(orderID string) ([]Return, error)
+	ResolveReturn(returnID string, approve bool) (*Return, error)
+	GetDeadLetters() ([]DeadLetter, error)
+	ReplayDeadLetter(id string, fixed *Order) (*Order, error)
+	AddWebhook(hook Webhook) (*Webhook, error)
+	GetWebhooks() ([]Webhook, error)
+	DeleteWebhook(id string) error
+	GetWebhookDeliveries(id string) ([]WebhookDelivery, error)
 	EmailNotify(Order) error
 	SaveReport(Order) error
 }
 
+// DeadLetter is an order event that could not be processed, held so it can be fixed and replayed
+type DeadLetter struct {
+	ID     string    `json:"id"` // ID of the original event
+	Order  Order     `json:"order"`
+	Reason string    `json:"reason"`
+	Failed time.Time `json:"failed"`
+}
+
+// PaymentProvider takes payment for an order, and refunds it, returning a reference for the payment or refund
+// It should give up when the context is done
+type PaymentProvider interface {
+	Charge(ctx context.Context, order Order) (string, error)
+	Refund(ctx context.Context, order Order, amount float32) (string, error)
+}
+
+// ValidateShipment checks the warehouse gave the details needed to track a shipment, and an address if the order has none
+func ValidateShipment(order Order, shipment Shipment) error {
+	if shipment.Carrier == "" || shipment.TrackingNumber == "" {
+		return errors.New("carrier and trackingNumber are required")
+	}
+
+	address := shipment.Address
+	if address == nil {
+		address = order.ShippingAddress
+	}
+
+	if address == nil || address.Name == "" || len(address.Lines) == 0 || address.Postcode == "" {
+		return errors.New("a shipping address with a name, lines and postcode is required")
+	}
+
+	return nil
+}
+
+// ErrValidation is returned by Validate, orders failing validation will never be valid so should not be retried
+var ErrValidation = errors.New("order failed validation")
+
 // Validate checks an order is correct
 func Validate(o Order) error {
 	if o.Amount <= 0 || len(o.LineItems) == 0 || o.Title == "" || o.ForUserID == "" {
-		return errors.New("order failed validation")
+		return ErrValidation
 	}
 
 	return nil
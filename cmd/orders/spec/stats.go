@@ -0,0 +1,155 @@
+package spec
+
+import (
+	"sort"
+	"time"
+)
+
+// DailyStats are sales figures for all orders created on a single day (UTC)
+// Orders are counted once paid for, cancelled orders are then taken back out of the revenue, items & products
+// NOTE Refunds for returned items are not taken off the revenue
+type DailyStats struct {
+	Date      string                   `json:"date"` // As YYYY-MM-DD
+	Orders    int                      `json:"orders"`
+	Cancelled int                      `json:"cancelled"`
+	Revenue   float32                  `json:"revenue"`
+	Items     int                      `json:"items"`
+	Products  map[string]*ProductSales `json:"products,omitempty"`
+}
+
+// ProductSales are the sales figures for a single product
+type ProductSales struct {
+	ProductID string  `json:"productId"`
+	Name      string  `json:"name"`
+	Count     int     `json:"count"`
+	Revenue   float32 `json:"revenue"`
+}
+
+// SalesSummary combines the stats for a range of days
+type SalesSummary struct {
+	From          string         `json:"from"`
+	To            string         `json:"to"`
+	Orders        int            `json:"orders"`
+	Cancelled     int            `json:"cancelled"`
+	Revenue       float32        `json:"revenue"`
+	AverageBasket float32        `json:"averageBasket"` // Average revenue of orders that weren't cancelled
+	AverageItems  float32        `json:"averageItems"`  // Average number of items in orders that weren't cancelled
+	TopProducts   []ProductSales `json:"topProducts"`
+	Days          []DailyStats   `json:"days"` // Every day in the range, without the products
+}
+
+// How many products are in the top products of a SalesSummary
+const TopProductCount = 10
+
+// StatsDay is the date an order is counted against in the stats, i.e. the day it was created
+func StatsDay(order Order) string {
+	return order.Created.UTC().Format("2006-01-02")
+}
+
+// AddOrder counts a paid order in the stats for its day
+func (d *DailyStats) AddOrder(order Order) {
+	d.Orders++
+	d.addItems(order, 1)
+}
+
+// CancelOrder takes a cancelled order back out of the stats for its day
+func (d *DailyStats) CancelOrder(order Order) {
+	d.Cancelled++
+	d.addItems(order, -1)
+}
+
+func (d *DailyStats) addItems(order Order, sign int) {
+	if d.Products == nil {
+		d.Products = map[string]*ProductSales{}
+	}
+
+	d.Revenue = float32(round2(float64(d.Revenue + float32(sign)*order.Amount)))
+
+	for _, line := range order.LineItems {
+		product := d.Products[line.Product.ID]
+		if product == nil {
+			product = &ProductSales{ProductID: line.Product.ID, Name: line.Product.Name}
+			d.Products[line.Product.ID] = product
+		}
+
+		product.Count += sign * line.Count
+		product.Revenue = float32(round2(float64(product.Revenue + float32(sign*line.Count)*line.Product.Cost)))
+		d.Items += sign * line.Count
+	}
+}
+
+// Summarise combines daily stats into a summary, days with no stats are included with zero counts
+// Both from & to are dates, and the range includes both of them
+func Summarise(days []DailyStats, from time.Time, to time.Time) SalesSummary {
+	summary := SalesSummary{
+		From:        from.Format("2006-01-02"),
+		To:          to.Format("2006-01-02"),
+		TopProducts: []ProductSales{},
+		Days:        []DailyStats{},
+	}
+
+	byDate := map[string]DailyStats{}
+	for _, d := range days {
+		byDate[d.Date] = d
+	}
+
+	items := 0
+	products := map[string]*ProductSales{}
+
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		date := day.Format("2006-01-02")
+		stats := byDate[date]
+		stats.Date = date
+
+		summary.Orders += stats.Orders
+		summary.Cancelled += stats.Cancelled
+		summary.Revenue += stats.Revenue
+		items += stats.Items
+
+		for id, p := range stats.Products {
+			if products[id] == nil {
+				products[id] = &ProductSales{ProductID: id, Name: p.Name}
+			}
+
+			products[id].Count += p.Count
+			products[id].Revenue += p.Revenue
+		}
+
+		stats.Products = nil
+		summary.Days = append(summary.Days, stats)
+	}
+
+	summary.Revenue = float32(round2(float64(summary.Revenue)))
+
+	if kept := summary.Orders - summary.Cancelled; kept > 0 {
+		summary.AverageBasket = float32(round2(float64(summary.Revenue) / float64(kept)))
+		summary.AverageItems = float32(round2(float64(items) / float64(kept)))
+	}
+
+	for _, p := range products {
+		if p.Count > 0 {
+			p.Revenue = float32(round2(float64(p.Revenue)))
+			summary.TopProducts = append(summary.TopProducts, *p)
+		}
+	}
+
+	// Most sold first, then by revenue, and by ID so the order is always the same
+	sort.Slice(summary.TopProducts, func(i, j int) bool {
+		a, b := summary.TopProducts[i], summary.TopProducts[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+
+		if a.Revenue != b.Revenue {
+			return a.Revenue > b.Revenue
+		}
+
+		return a.ProductID < b.ProductID
+	})
+
+	if len(summary.TopProducts) > TopProductCount {
+		summary.TopProducts = summary.TopProducts[:TopProductCount]
+	}
+
+	return summary
+}
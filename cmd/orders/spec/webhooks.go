@@ -0,0 +1,79 @@
+package spec
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Webhook is a subscription to order events, which are POSTed to the URL as they happen
+type Webhook struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Events  []string  `json:"events"`           // Event types to send, empty means all of them
+	Secret  string    `json:"secret,omitempty"` // Used to sign payloads, only ever returned when the webhook is added
+	Created time.Time `json:"created"`
+}
+
+// WebhookEvent is the payload sent to webhooks
+type WebhookEvent struct {
+	Type  string    `json:"type"`
+	Order Order     `json:"order"`
+	At    time.Time `json:"at"`
+}
+
+// WebhookDelivery is a log entry for a single attempt at sending an event to a webhook
+type WebhookDelivery struct {
+	WebhookID  string    `json:"webhookId"`
+	Event      string    `json:"event"`
+	OrderID    string    `json:"orderId"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Success    bool      `json:"success"`
+	At         time.Time `json:"at"`
+}
+
+// EventType is the webhook event type for an order status, e.g. 'order.received'
+func EventType(status OrderStatus) string {
+	return "order." + string(status)
+}
+
+// Wants checks if the webhook is subscribed to an event type
+func (w Webhook) Wants(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+
+	for _, e := range w.Events {
+		if e == eventType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateWebhook checks a webhook has a usable URL and only known event types
+func ValidateWebhook(w Webhook) error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook url '%s' must be an absolute http or https URL", w.URL)
+	}
+
+	for _, e := range w.Events {
+		known := false
+
+		for status := range transitions {
+			if e == EventType(status) {
+				known = true
+			}
+		}
+
+		if !known {
+			return fmt.Errorf("unknown event type '%s'", e)
+		}
+	}
+
+	return nil
+}